@@ -0,0 +1,201 @@
+package pbstream
+
+import (
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// CanonicalHints tells Canonicalize what it cannot learn from the
+// wire. Paths are field numbers from the top level, as for ExtractPath.
+type CanonicalHints struct {
+	// Messages are the embedded message fields, which are canonicalized
+	// recursively. Groups are always canonicalized inside, but only
+	// merged if listed here.
+	Messages [][]int32
+	// Repeated are the repeated fields, where every occurrence is kept
+	Repeated []RepeatedField
+}
+
+// RepeatedField marks a repeated field for Canonicalize. WireType is
+// the encoding of each element. For WireVarint, WireFixed32 and
+// WireFixed64 all values are written as one packed field. For
+// WireLengthPrefix (strings, bytes, messages) and WireBeginGroup,
+// the occurrences are kept in their original order.
+type RepeatedField struct {
+	Path     []int32
+	WireType int
+}
+
+// Canonicalize re-encodes a message so that two encoders produce the
+// same bytes for the same data, which we need before signing.
+//
+// Fields are sorted by number (keeping the order of occurrences for
+// repeated fields), and varints, tags and lengths use the shortest
+// encoding. Duplicates of a varint or fixed field that is not listed
+// as repeated collapse into the last occurrence, and duplicates of a
+// message in hints.Messages that is not repeated are merged into one
+// message, like proto.Unmarshal does.
+//
+// Without a schema, a repeated string, a repeated message and a split
+// singular message look the same on the wire, so without a hint, all
+// occurrences of a length prefixed field or a group are kept in order.
+// Such a field is kept as bytes, so the fields inside an embedded
+// message are only canonicalized if its path is in hints.Messages.
+// Unknown fields are sorted in like the others, and empty packed
+// fields are dropped.
+func Canonicalize(bz []byte, hints CanonicalHints) ([]byte, error) {
+	return canonicalize(bz, nil, &hints)
+}
+
+func canonicalize(bz []byte, parent []int32, hints *CanonicalHints) ([]byte, error) {
+	if len(parent) > MaxNestingDepth {
+		return nil, errors.Errorf("Messages nested deeper than %d", MaxNestingDepth)
+	}
+	// group the occurrences by field number, they are already in order
+	fields := make(map[int32][]Field)
+	var nums []int32
+	it := NewFieldIterator(bz)
+	for it.Next() {
+		num := it.FieldNum()
+		if _, ok := fields[num]; !ok {
+			nums = append(nums, num)
+		}
+		fields[num] = append(fields[num], Field{Num: num, WireType: it.WireType(), Raw: it.Raw()})
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+
+	res := make([]byte, 0, len(bz))
+	for _, num := range nums {
+		occurrences := fields[num]
+		path := make([]int32, len(parent)+1)
+		copy(path, parent)
+		path[len(parent)] = num
+
+		elemWire, repeated := hints.repeated(path)
+		message := hints.isMessage(path)
+		last := occurrences[len(occurrences)-1]
+
+		switch {
+		case repeated && (elemWire == WireVarint || fixedWidth(elemWire) > 0):
+			vals, err := ExtractRepeatedScalar(bz, num, elemWire)
+			if err != nil {
+				return nil, err
+			}
+			if len(vals) > 0 {
+				res = AppendPacked(res, num, elemWire, vals)
+			}
+		case repeated || !(message || allScalars(occurrences)):
+			// we cannot tell if it is repeated, so keep them all
+			for _, field := range occurrences {
+				var err error
+				res, err = appendCanonical(res, field, path, message, hints)
+				if err != nil {
+					return nil, err
+				}
+			}
+		case message:
+			// merging is the same as parsing the bodies one after another
+			var merged []byte
+			for _, field := range occurrences {
+				body, err := parseEmbedded(num, field.WireType, field.Raw)
+				if err != nil {
+					return nil, err
+				}
+				merged = append(merged, body...)
+			}
+			var err error
+			res, err = appendMessage(res, num, last.WireType, merged, path, hints)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			var err error
+			res, err = appendCanonical(res, last, path, false, hints)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return res, nil
+}
+
+// allScalars is true if none of the fields is length prefixed or a group
+func allScalars(fields []Field) bool {
+	for _, field := range fields {
+		if field.WireType != WireVarint && fixedWidth(field.WireType) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// appendCanonical adds one field with the shortest encoding
+func appendCanonical(res []byte, field Field, path []int32, message bool, hints *CanonicalHints) ([]byte, error) {
+	if message && field.WireType != WireLengthPrefix && field.WireType != WireBeginGroup {
+		return nil, errors.Errorf("Field %d is not an embedded message (wire type %d)", field.Num, field.WireType)
+	}
+	switch field.WireType {
+	case WireVarint:
+		val, _, err := parseVarUint(field.Raw)
+		if err != nil {
+			return nil, err
+		}
+		return AppendVarintField(res, field.Num, val), nil
+	case WireFixed32, WireFixed64:
+		res = AppendTag(res, field.Num, field.WireType)
+		return append(res, field.Raw[:fixedWidth(field.WireType)]...), nil
+	case WireLengthPrefix:
+		payload, err := ParseBytesField(field.Raw)
+		if err != nil {
+			return nil, err
+		}
+		if message {
+			return appendMessage(res, field.Num, field.WireType, payload, path, hints)
+		}
+		return AppendBytesField(res, field.Num, payload), nil
+	case WireBeginGroup:
+		body, err := ParseGroupField(field.Num, field.Raw)
+		if err != nil {
+			return nil, err
+		}
+		return appendMessage(res, field.Num, field.WireType, body, path, hints)
+	default:
+		return nil, errors.Errorf("proto: illegal wireType %d", field.WireType)
+	}
+}
+
+// appendMessage canonicalizes the body of an embedded message,
+// and adds it as a length prefixed field or a group
+func appendMessage(res []byte, field int32, wireType int, body []byte, path []int32, hints *CanonicalHints) ([]byte, error) {
+	body, err := canonicalize(body, path, hints)
+	if err != nil {
+		return nil, err
+	}
+	switch wireType {
+	case WireLengthPrefix:
+		return AppendBytesField(res, field, body), nil
+	case WireBeginGroup:
+		res = AppendTag(res, field, WireBeginGroup)
+		res = append(res, body...)
+		return AppendTag(res, field, WireEndGroup), nil
+	default:
+		return nil, errors.Errorf("Field %d is not an embedded message (wire type %d)", field, wireType)
+	}
+}
+
+func (h *CanonicalHints) isMessage(path []int32) bool {
+	return isMessagePath(h.Messages, path)
+}
+
+func (h *CanonicalHints) repeated(path []int32) (int, bool) {
+	for _, r := range h.Repeated {
+		if equalPath(r.Path, path) {
+			return r.WireType, true
+		}
+	}
+	return 0, false
+}
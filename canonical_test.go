@@ -0,0 +1,197 @@
+package pbstream
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var sendHints = CanonicalHints{
+	Messages: [][]int32{{1}, {2}, {2, 3}, {3}, {3, 2}},
+	Repeated: []RepeatedField{{Path: []int32{32}, WireType: WireLengthPrefix}},
+}
+
+var phonebookHints = CanonicalHints{
+	Messages: [][]int32{{2}},
+	Repeated: []RepeatedField{
+		{Path: []int32{2}, WireType: WireLengthPrefix},
+		{Path: []int32{3}, WireType: WireVarint},
+		{Path: []int32{4}, WireType: WireFixed32},
+	},
+}
+
+func TestCanonicalizeStable(t *testing.T) {
+	cases := []struct {
+		file  string
+		hints CanonicalHints
+	}{
+		{"testdata/send_msg.bin", sendHints},
+		{"testdata/issue_msg.bin", sendHints},
+		{"testdata/phonebook.bin", phonebookHints},
+		// the numbers must not be dropped without hints
+		{"testdata/phonebook.bin", CanonicalHints{}},
+		{"testdata/person_john.bin", CanonicalHints{}},
+		{"testdata/employee_marmot.bin", CanonicalHints{Messages: [][]int32{{2}}}},
+		{"testdata/mixed.bin", CanonicalHints{}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.file, func(t *testing.T) {
+			bz, err := ioutil.ReadFile(tc.file)
+			require.NoError(t, err)
+			// the go encoder already writes canonical bytes
+			res, err := Canonicalize(bz, tc.hints)
+			require.NoError(t, err)
+			assert.Equal(t, bz, res)
+		})
+	}
+}
+
+func TestCanonicalizeSendTx(t *testing.T) {
+	expected, err := ioutil.ReadFile("testdata/send_msg.bin")
+	require.NoError(t, err)
+
+	// send message first, with the amount split in two, and a bad amount
+	// that gets overwritten, then the fee
+	var bz []byte
+	bz, send := BeginMessage(bz, 2)
+	bz, amount := BeginMessage(bz, 3)
+	bz = AppendVarintField(bz, 1, 99)
+	bz = EndMessage(bz, amount)
+	bz = AppendBytesField(bz, 2, []byte{0x74, 0x23, 0x12, 0x63, 0x82})
+	bz = AppendBytesField(bz, 1, []byte("12345678901234567890"))
+	bz, amount = BeginMessage(bz, 3)
+	// 18500 with a padded varint
+	bz = append(bz, 0x08, 0xc4, 0x90, 0x81, 0x80, 0x00)
+	bz = AppendStringField(bz, 2, "ATOM")
+	bz = EndMessage(bz, amount)
+	bz = EndMessage(bz, send)
+	// the fee, with a non-minimal tag and length
+	bz = append(bz, 0x8a, 0x00, 0x87, 0x00)
+	bz = AppendVarintField(bz, 1, 1)
+	bz = AppendStringField(bz, 2, "PHO")
+	bz = append(bz, 0x0a, 0x03)
+	bz = AppendVarintField(bz, 1, 500)
+
+	res, err := Canonicalize(bz, sendHints)
+	require.NoError(t, err)
+	assert.Equal(t, expected, res)
+	// and once canonical, it stays that way
+	again, err := Canonicalize(res, sendHints)
+	require.NoError(t, err)
+	assert.Equal(t, res, again)
+
+	// without hints, the send message is left as bytes
+	res, err = Canonicalize(bz, CanonicalHints{})
+	require.NoError(t, err)
+	raw, _, err := ExtractField(res, 2)
+	require.NoError(t, err)
+	send2, err := ParseBytesField(raw)
+	require.NoError(t, err)
+	raw, _, err = ExtractField(bz, 2)
+	require.NoError(t, err)
+	send1, err := ParseBytesField(raw)
+	require.NoError(t, err)
+	assert.Equal(t, send1, send2)
+	// and both fees are kept, in order, as they may be repeated
+	fees, err := ExtractAll(res, 1)
+	require.NoError(t, err)
+	require.Len(t, fees, 2)
+	fee, err := ParseBytesField(fees[0].Raw)
+	require.NoError(t, err)
+	assert.Equal(t, append(AppendVarintField(nil, 1, 1), AppendStringField(nil, 2, "PHO")...), fee)
+	fee, err = ParseBytesField(fees[1].Raw)
+	require.NoError(t, err)
+	assert.Equal(t, AppendVarintField(nil, 1, 500), fee)
+}
+
+func TestCanonicalizeRepeated(t *testing.T) {
+	// unpacked numbers, split over the message
+	var bz []byte
+	bz = AppendVarintField(bz, 3, 7)
+	bz = AppendStringField(bz, 2, "b")
+	bz = AppendPacked(bz, 3, WireVarint, []uint64{8, 9})
+	bz = AppendStringField(bz, 1, "x")
+	bz = AppendStringField(bz, 2, "a")
+	bz = AppendVarintField(bz, 3, 10)
+	bz = AppendVarintField(bz, 5, 1)
+	// an empty packed field is dropped
+	bz = AppendPacked(bz, 4, WireFixed32, nil)
+	bz = AppendVarintField(bz, 5, 2)
+
+	hints := CanonicalHints{
+		Repeated: []RepeatedField{
+			{Path: []int32{2}, WireType: WireLengthPrefix},
+			{Path: []int32{3}, WireType: WireVarint},
+			{Path: []int32{4}, WireType: WireFixed32},
+		},
+	}
+	res, err := Canonicalize(bz, hints)
+	require.NoError(t, err)
+
+	var expected []byte
+	expected = AppendStringField(expected, 1, "x")
+	expected = AppendStringField(expected, 2, "b")
+	expected = AppendStringField(expected, 2, "a")
+	expected = AppendPacked(expected, 3, WireVarint, []uint64{7, 8, 9, 10})
+	expected = AppendVarintField(expected, 5, 2)
+	assert.Equal(t, expected, res)
+
+	// without the hints, only the scalars collapse, the last one wins
+	res, err = Canonicalize(bz, CanonicalHints{})
+	require.NoError(t, err)
+	expected = AppendStringField(nil, 1, "x")
+	expected = AppendStringField(expected, 2, "b")
+	expected = AppendStringField(expected, 2, "a")
+	expected = AppendVarintField(expected, 3, 7)
+	expected = AppendPacked(expected, 3, WireVarint, []uint64{8, 9})
+	expected = AppendVarintField(expected, 3, 10)
+	expected = AppendPacked(expected, 4, WireFixed32, nil)
+	expected = AppendVarintField(expected, 5, 2)
+	assert.Equal(t, expected, res)
+}
+
+func TestCanonicalizeGroups(t *testing.T) {
+	// groups are sorted inside, and kept in order without hints
+	bz := []byte{0x13, 0x18, 3, 0x08, 1, 0x14, 0x08, 5, 0x13, 0x10, 2, 0x08, 4, 0x14}
+	res, err := Canonicalize(bz, CanonicalHints{})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x08, 5, 0x13, 0x08, 1, 0x18, 3, 0x14, 0x13, 0x08, 4, 0x10, 2, 0x14}, res)
+	hints := CanonicalHints{Repeated: []RepeatedField{{Path: []int32{2}, WireType: WireBeginGroup}}}
+	repeated, err := Canonicalize(bz, hints)
+	require.NoError(t, err)
+	assert.Equal(t, res, repeated)
+
+	// and merged if they are singular messages
+	hints = CanonicalHints{Messages: [][]int32{{2}}}
+	res, err = Canonicalize(bz, hints)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x08, 5, 0x13, 0x08, 4, 0x10, 2, 0x18, 3, 0x14}, res)
+
+	// groups nested too deep
+	_, err = Canonicalize(nestedGroups(MaxNestingDepth+1), CanonicalHints{})
+	assert.Error(t, err)
+}
+
+func TestCanonicalizeErrors(t *testing.T) {
+	bz, err := ioutil.ReadFile("testdata/send_msg.bin")
+	require.NoError(t, err)
+
+	// amount is not a message
+	_, err = Canonicalize(bz, CanonicalHints{Messages: [][]int32{{1}, {1, 1}}})
+	assert.Error(t, err)
+	_, err = Canonicalize(bz, CanonicalHints{
+		Messages: [][]int32{{1}, {1, 1}},
+		Repeated: []RepeatedField{{Path: []int32{1, 1}, WireType: WireLengthPrefix}},
+	})
+	assert.Error(t, err)
+	// denom is not a number
+	_, err = Canonicalize(bz, CanonicalHints{
+		Messages: [][]int32{{1}},
+		Repeated: []RepeatedField{{Path: []int32{1, 2}, WireType: WireFixed32}},
+	})
+	assert.Error(t, err)
+	_, err = Canonicalize(bz[:len(bz)-1], CanonicalHints{})
+	assert.Error(t, err)
+}
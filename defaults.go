@@ -0,0 +1,83 @@
+package pbstream
+
+import (
+	"github.com/pkg/errors"
+)
+
+// The OrDefault functions read one field like ExtractMergedPath,
+// so they agree with proto.Unmarshal, and parse it into a go type.
+// If the field is absent, they return the proto3 default value
+// for that type, rather than an error. They still fail if the data
+// is malformed or the field has an unexpected encoding.
+
+// Uint64OrDefault reads any uint32, uint64, fixed32, fixed64,
+// bool or enum field, returning 0 if it is absent
+func Uint64OrDefault(bz []byte, next int32, rest ...int32) (uint64, error) {
+	raw, wireType, found, err := extractMerged(bz, next, rest)
+	if err != nil || !found {
+		return 0, err
+	}
+	val, _, err := ParseAnyInt(wireType, raw)
+	return val, err
+}
+
+// Int64OrDefault reads any int32, int64, sfixed64 or enum field,
+// returning 0 if it is absent.
+// (sfixed32 is not sign extended, use int32(Uint64OrDefault) instead)
+func Int64OrDefault(bz []byte, next int32, rest ...int32) (int64, error) {
+	val, err := Uint64OrDefault(bz, next, rest...)
+	return int64(val), err
+}
+
+// Sint64OrDefault reads any sint32 or sint64 field,
+// returning 0 if it is absent
+func Sint64OrDefault(bz []byte, next int32, rest ...int32) (int64, error) {
+	val, err := Uint64OrDefault(bz, next, rest...)
+	return UnpackSint(val), err
+}
+
+// BoolOrDefault reads a bool field, returning false if it is absent
+func BoolOrDefault(bz []byte, next int32, rest ...int32) (bool, error) {
+	val, err := Uint64OrDefault(bz, next, rest...)
+	return val != 0, err
+}
+
+// Float64OrDefault reads a double field, returning 0 if it is absent
+func Float64OrDefault(bz []byte, next int32, rest ...int32) (float64, error) {
+	raw, wireType, found, err := extractMerged(bz, next, rest)
+	if err != nil || !found {
+		return 0, err
+	}
+	return ParseFloat64(wireType, raw)
+}
+
+// Float32OrDefault reads a float field, returning 0 if it is absent
+func Float32OrDefault(bz []byte, next int32, rest ...int32) (float32, error) {
+	raw, wireType, found, err := extractMerged(bz, next, rest)
+	if err != nil || !found {
+		return 0, err
+	}
+	return ParseFloat32(wireType, raw)
+}
+
+// BytesOrDefault reads a bytes field, returning an empty
+// (non-nil) slice if it is absent
+func BytesOrDefault(bz []byte, next int32, rest ...int32) ([]byte, error) {
+	raw, wireType, found, err := extractMerged(bz, next, rest)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return []byte{}, nil
+	}
+	if wireType != WireLengthPrefix {
+		return nil, errors.Errorf("Unknown wireType for BytesOrDefault: %d", wireType)
+	}
+	return ParseBytesField(raw)
+}
+
+// StringOrDefault reads a string field, returning "" if it is absent
+func StringOrDefault(bz []byte, next int32, rest ...int32) (string, error) {
+	val, err := BytesOrDefault(bz, next, rest...)
+	return string(val), err
+}
@@ -0,0 +1,79 @@
+package pbstream
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOrDefault(t *testing.T) {
+	mixed, err := ioutil.ReadFile("testdata/mixed.bin")
+	require.NoError(t, err)
+	employee, err := ioutil.ReadFile("testdata/employee_marmot.bin")
+	require.NoError(t, err)
+
+	// present values
+	u, err := Uint64OrDefault(mixed, 6)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1122334455667788), u)
+	i, err := Int64OrDefault(mixed, 4)
+	require.NoError(t, err)
+	assert.Equal(t, int64(-8877665544332211), i)
+	i, err = Int64OrDefault(employee, 2, 2)
+	require.NoError(t, err)
+	assert.Equal(t, int64(-37), i)
+	i, err = Sint64OrDefault(mixed, 8)
+	require.NoError(t, err)
+	assert.Equal(t, int64(-835), i)
+	b, err := BoolOrDefault(mixed, 13)
+	require.NoError(t, err)
+	assert.True(t, b)
+	d, err := Float64OrDefault(mixed, 2)
+	require.NoError(t, err)
+	assert.InEpsilon(t, -56.78, d, 0.0001)
+	f, err := Float32OrDefault(mixed, 1)
+	require.NoError(t, err)
+	assert.InEpsilon(t, float32(1.234), f, 0.0001)
+	s, err := StringOrDefault(employee, 2, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "Mr. Marmot", s)
+	bz, err := BytesOrDefault(mixed, 15)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{17, 32, 16, 0, 4}, bz)
+
+	// absent values, including missing parents
+	u, err = Uint64OrDefault(mixed, 20)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), u)
+	i, err = Sint64OrDefault(employee, 3, 1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), i)
+	b, err = BoolOrDefault(employee, 2, 4)
+	require.NoError(t, err)
+	assert.False(t, b)
+	d, err = Float64OrDefault(mixed, 20)
+	require.NoError(t, err)
+	assert.Equal(t, 0.0, d)
+	f, err = Float32OrDefault(mixed, 20)
+	require.NoError(t, err)
+	assert.Equal(t, float32(0), f)
+	s, err = StringOrDefault(employee, 2, 3)
+	require.NoError(t, err)
+	assert.Equal(t, "", s)
+	bz, err = BytesOrDefault(employee, 5)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{}, bz)
+
+	// wrong type is an error
+	_, err = StringOrDefault(mixed, 3)
+	assert.Error(t, err)
+	_, err = Uint64OrDefault(mixed, 14)
+	assert.Error(t, err)
+	_, err = Float64OrDefault(mixed, 1)
+	assert.Error(t, err)
+	// as is corrupt data, even if the field would be missing
+	_, err = Int64OrDefault(mixed[:len(mixed)-1], 20)
+	assert.Error(t, err)
+}
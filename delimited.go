@@ -0,0 +1,124 @@
+package pbstream
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultMaxMessageSize is the largest message a MessageScanner
+// accepts unless changed with SetMaxSize (same as protobuf-java)
+const DefaultMaxMessageSize = 64 << 20
+
+// MessageScanner reads a stream of varint length-delimited
+// messages, as written by writeDelimitedTo in other protobuf
+// libraries, or by DelimitedWriter. It works like bufio.Scanner:
+//
+//	scan := NewMessageScanner(r)
+//	for scan.Scan() {
+//		raw, wire, err := ExtractPath(scan.Message(), 1, 2)
+//		...
+//	}
+//	if err := scan.Err(); err != nil {
+//		...
+//	}
+type MessageScanner struct {
+	r   *bufio.Reader
+	max int
+	buf bytes.Buffer
+	err error
+}
+
+// NewMessageScanner reads messages from r. If r is not
+// a *bufio.Reader, it is wrapped in one.
+func NewMessageScanner(r io.Reader) *MessageScanner {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &MessageScanner{r: br, max: DefaultMaxMessageSize}
+}
+
+// SetMaxSize sets the largest message we will read into memory.
+// Scan stops with an error if a message claims to be larger.
+func (m *MessageScanner) SetMaxSize(max int) {
+	m.max = max
+}
+
+// Scan reads the next message, returning false at the end of the
+// stream or on an error (check Err).
+func (m *MessageScanner) Scan() bool {
+	if m.err != nil {
+		return false
+	}
+	size, err := binary.ReadUvarint(m.r)
+	if err == io.EOF {
+		// clean end between two messages
+		m.buf.Reset()
+		return false
+	}
+	if err != nil {
+		m.err = errors.WithStack(err)
+		return false
+	}
+	if size > uint64(m.max) {
+		m.err = errors.Errorf("Message of %d bytes larger than max size %d", size, m.max)
+		return false
+	}
+
+	if err := readSized(&m.buf, m.r, int64(size)); err != nil {
+		m.err = err
+		return false
+	}
+	return true
+}
+
+// readSized reads exactly size bytes from r into buf, reusing its
+// memory. The buffer grows as the data arrives, so a bogus length
+// prefix cannot make us allocate the max size up front.
+func readSized(buf *bytes.Buffer, r io.Reader, size int64) error {
+	buf.Reset()
+	if _, err := io.CopyN(buf, r, size); err != nil {
+		return unexpectedEOF(err)
+	}
+	return nil
+}
+
+// Message returns the current message. The data is only valid
+// until the next call to Scan, copy it if you need to keep it.
+func (m *MessageScanner) Message() []byte {
+	return m.buf.Bytes()
+}
+
+// Err returns the error that stopped the scan, if any.
+// It is nil if we stopped at the end of the stream.
+func (m *MessageScanner) Err() error {
+	return m.err
+}
+
+// DelimitedWriter writes messages prefixed with their varint
+// length, so they can be read back with a MessageScanner.
+type DelimitedWriter struct {
+	w      io.Writer
+	prefix [binary.MaxVarintLen64]byte
+}
+
+// NewDelimitedWriter writes messages to w
+func NewDelimitedWriter(w io.Writer) *DelimitedWriter {
+	return &DelimitedWriter{w: w}
+}
+
+// WriteMessage writes the length of msg followed by msg
+func (d *DelimitedWriter) WriteMessage(msg []byte) error {
+	n := binary.PutUvarint(d.prefix[:], uint64(len(msg)))
+	if _, err := d.w.Write(d.prefix[:n]); err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := d.w.Write(msg); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package pbstream
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"testing"
+	"testing/iotest"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageScanner(t *testing.T) {
+	files := []string{
+		"testdata/send_msg.bin",
+		"testdata/issue_msg.bin",
+		"testdata/phonebook.bin",
+	}
+	var msgs [][]byte
+	var buf bytes.Buffer
+	w := NewDelimitedWriter(&buf)
+	for _, file := range files {
+		bz, err := ioutil.ReadFile(file)
+		require.NoError(t, err)
+		msgs = append(msgs, bz)
+		require.NoError(t, w.WriteMessage(bz))
+	}
+	// empty messages are allowed
+	msgs = append(msgs, []byte{})
+	require.NoError(t, w.WriteMessage(nil))
+	stream := buf.Bytes()
+
+	scan := NewMessageScanner(iotest.OneByteReader(bytes.NewReader(stream)))
+	var i int
+	for scan.Scan() {
+		require.True(t, i < len(msgs))
+		assert.Equal(t, msgs[i], scan.Message())
+		i++
+	}
+	require.NoError(t, scan.Err())
+	assert.Equal(t, len(msgs), i)
+
+	// messages plug into ExtractPath
+	scan = NewMessageScanner(bytes.NewReader(stream))
+	var denoms []string
+	for scan.Scan() && len(denoms) < 2 {
+		raw, _, err := ExtractPath(scan.Message(), 1, 2)
+		require.NoError(t, err)
+		denom, err := ParseString(raw)
+		require.NoError(t, err)
+		denoms = append(denoms, denom)
+	}
+	require.NoError(t, scan.Err())
+	assert.Equal(t, []string{"PHO", "SPC"}, denoms)
+
+	// too big
+	scan = NewMessageScanner(bytes.NewReader(stream))
+	scan.SetMaxSize(len(msgs[0]))
+	assert.True(t, scan.Scan())
+	assert.True(t, scan.Scan())
+	assert.False(t, scan.Scan())
+	assert.Error(t, scan.Err())
+
+	// truncated in the middle of a message, or the length
+	scan = NewMessageScanner(bytes.NewReader(stream[:len(msgs[0])]))
+	assert.False(t, scan.Scan())
+	assert.Equal(t, io.ErrUnexpectedEOF, errors.Cause(scan.Err()))
+	scan = NewMessageScanner(bytes.NewReader([]byte{0x80}))
+	assert.False(t, scan.Scan())
+	assert.Equal(t, io.ErrUnexpectedEOF, errors.Cause(scan.Err()))
+}
+
+// allocated returns how many bytes f allocates
+func allocated(f func()) uint64 {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	f()
+	runtime.ReadMemStats(&after)
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+func TestMessageScannerBogusLength(t *testing.T) {
+	// claims 60 MB, but only has a few bytes
+	bogus := append(AppendVarint(nil, 60<<20), "abc"...)
+	used := allocated(func() {
+		scan := NewMessageScanner(bytes.NewReader(bogus))
+		assert.False(t, scan.Scan())
+		assert.Equal(t, io.ErrUnexpectedEOF, errors.Cause(scan.Err()))
+	})
+	assert.True(t, used < 1<<20, "allocated %d bytes", used)
+}
+
+func TestDelimitedWriterErrors(t *testing.T) {
+	w := NewDelimitedWriter(errWriter{})
+	assert.Error(t, w.WriteMessage([]byte("hello")))
+}
+
+type errWriter struct{}
+
+func (errWriter) Write([]byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
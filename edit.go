@@ -0,0 +1,240 @@
+package pbstream
+
+import (
+	"github.com/pkg/errors"
+)
+
+// fieldSpan is the location of one field inside a message.
+// The header is bz[start:body], the value (or payload for length
+// prefixed fields, or inner fields for groups) is bz[body:bodyEnd],
+// and bz[bodyEnd:end] is the end group marker, if any.
+type fieldSpan struct {
+	start, body, bodyEnd, end int
+	wireType                  int
+}
+
+// findSpans returns the location of every occurrence of field
+func findSpans(bz []byte, field int32) ([]fieldSpan, error) {
+	var res []fieldSpan
+	it := NewFieldIterator(bz)
+	for it.Next() {
+		if it.FieldNum() != field {
+			continue
+		}
+		raw := it.Raw()
+		span := fieldSpan{
+			start:    it.Offset(),
+			body:     it.Offset() + it.header,
+			end:      it.Offset() + it.header + len(raw),
+			wireType: it.WireType(),
+		}
+		span.bodyEnd = span.end
+		switch it.WireType() {
+		case WireLengthPrefix:
+			payload, err := ParseBytesField(raw)
+			if err != nil {
+				return nil, err
+			}
+			span.body = span.end - len(payload)
+		case WireBeginGroup:
+			inner, err := ParseGroupField(field, raw)
+			if err != nil {
+				return nil, err
+			}
+			span.bodyEnd = span.body + len(inner)
+		}
+		res = append(res, span)
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// rewrap puts a new body in place of the body of an embedded message,
+// keeping the original header (and end group marker), and fixing
+// the length prefix if needed
+func rewrap(res []byte, bz []byte, span fieldSpan, body []byte) []byte {
+	if span.wireType == WireBeginGroup {
+		res = append(res, bz[span.start:span.body]...)
+		res = append(res, body...)
+		return append(res, bz[span.bodyEnd:span.end]...)
+	}
+	header, _, _, _ := parseFieldHeader(bz[span.start:])
+	res = append(res, bz[span.start:span.start+header]...)
+	res = AppendVarint(res, uint64(len(body)))
+	return append(res, body...)
+}
+
+// SetPath returns a copy of bz where the field at the end of the path
+// is replaced by value, which must be one complete encoded field with
+// the same field number (as made by AppendStringField and friends).
+//
+// Following protobuf merge rules, it goes into the last occurrence
+// of each message along the path and replaces the last occurrence of
+// the field. Missing fields or messages are appended to the end of
+// their parent. Every length prefix along the path is recomputed, and
+// all other bytes, including other occurrences (which may be entries
+// of a repeated field), unknown fields and their order, are kept as
+// they were.
+//
+// Note that a first-match reader like ExtractPath still sees an
+// earlier copy of the field, if there is one. For singular fields,
+// use SetPathExclusive.
+func SetPath(bz []byte, value []byte, path ...int32) ([]byte, error) {
+	if err := checkSetValue(value, path); err != nil {
+		return nil, err
+	}
+	return setPath(bz, value, path, false)
+}
+
+// SetPathExclusive works like SetPath, but also drops every other
+// occurrence of the field from the message it is written to, so every
+// reader sees value there. Only use it if the field is not repeated.
+//
+// Earlier copies of the messages along the path are still left alone,
+// as without a schema we cannot tell them from repeated entries.
+func SetPathExclusive(bz []byte, value []byte, path ...int32) ([]byte, error) {
+	if err := checkSetValue(value, path); err != nil {
+		return nil, err
+	}
+	return setPath(bz, value, path, true)
+}
+
+// checkSetValue makes sure value is one field, matching the path
+func checkSetValue(value []byte, path []int32) error {
+	if len(path) == 0 {
+		return errors.New("SetPath needs a path")
+	}
+	_, fieldNum, _, err := parseFieldHeader(value)
+	if err != nil {
+		return err
+	}
+	size, err := skipField(value)
+	if err != nil {
+		return err
+	}
+	if size != len(value) {
+		return errors.Errorf("Value must hold exactly one field")
+	}
+	if fieldNum != path[len(path)-1] {
+		return errors.Errorf("Value is field %d, path ends in %d", fieldNum, path[len(path)-1])
+	}
+	return nil
+}
+
+// setPath writes value along the chain of last occurrences. If
+// exclusive, the other occurrences of the final field are dropped.
+func setPath(bz []byte, value []byte, path []int32, exclusive bool) ([]byte, error) {
+	spans, err := findSpans(bz, path[0])
+	if err != nil {
+		return nil, err
+	}
+	res := make([]byte, 0, len(bz)+len(value)+16)
+
+	// not there, add it to the end
+	if len(spans) == 0 {
+		res = append(res, bz...)
+		if len(path) == 1 {
+			return append(res, value...), nil
+		}
+		body, err := setPath(nil, value, path[1:], exclusive)
+		if err != nil {
+			return nil, err
+		}
+		return AppendBytesField(res, path[0], body), nil
+	}
+
+	last := spans[len(spans)-1]
+	if len(path) == 1 && exclusive {
+		var pos int
+		for _, span := range spans[:len(spans)-1] {
+			res = append(res, bz[pos:span.start]...)
+			pos = span.end
+		}
+		res = append(res, bz[pos:last.start]...)
+	} else {
+		res = append(res, bz[:last.start]...)
+	}
+
+	if len(path) == 1 {
+		res = append(res, value...)
+	} else {
+		if last.wireType != WireLengthPrefix && last.wireType != WireBeginGroup {
+			return nil, errors.Errorf("Field %d is not an embedded message (wire type %d)", path[0], last.wireType)
+		}
+		body, err := setPath(bz[last.body:last.bodyEnd], value, path[1:], exclusive)
+		if err != nil {
+			return nil, err
+		}
+		res = rewrap(res, bz, last, body)
+	}
+	return append(res, bz[last.end:]...), nil
+}
+
+// RemovePath returns a copy of bz without the field at the end of the
+// path. Every occurrence is removed, in every occurrence of the messages
+// along the path (so it also works on repeated messages), and their
+// length prefixes are recomputed. Messages that end up empty are kept.
+//
+// It is not an error if the field is not there, the result is then
+// the same as the input.
+func RemovePath(bz []byte, path ...int32) ([]byte, error) {
+	if len(path) == 0 {
+		return nil, errors.New("RemovePath needs a path")
+	}
+	return removePath(bz, path)
+}
+
+// RemoveAll returns a copy of bz without any occurrence
+// of the field at the top level
+func RemoveAll(bz []byte, field int32) ([]byte, error) {
+	return removePath(bz, []int32{field})
+}
+
+func removePath(bz []byte, path []int32) ([]byte, error) {
+	spans, err := findSpans(bz, path[0])
+	if err != nil {
+		return nil, err
+	}
+	res := make([]byte, 0, len(bz))
+	var pos int
+	for _, span := range spans {
+		res = append(res, bz[pos:span.start]...)
+		pos = span.end
+		// recursion guard - we got to the end, drop it
+		if len(path) == 1 {
+			continue
+		}
+
+		if span.wireType != WireLengthPrefix && span.wireType != WireBeginGroup {
+			return nil, errors.Errorf("Field %d is not an embedded message (wire type %d)", path[0], span.wireType)
+		}
+		body, err := removePath(bz[span.body:span.bodyEnd], path[1:])
+		if err != nil {
+			return nil, err
+		}
+		res = rewrap(res, bz, span, body)
+	}
+	return append(res, bz[pos:]...), nil
+}
+
+// KeepOnly returns a copy of bz with only the listed top level
+// fields, in their original order and encoding. Everything else,
+// including unknown fields, is dropped.
+func KeepOnly(bz []byte, fields ...int32) ([]byte, error) {
+	res := make([]byte, 0, len(bz))
+	it := NewFieldIterator(bz)
+	for it.Next() {
+		for _, field := range fields {
+			if it.FieldNum() == field {
+				res = append(res, bz[it.Offset():it.Offset()+it.header+len(it.Raw())]...)
+				break
+			}
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
@@ -0,0 +1,292 @@
+package pbstream
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// buildSendTx makes a Tx like send_msg.bin, with the given
+// denom for the amount, and extra bytes at the end of the fee
+func buildSendTx(denom string, feeExtra []byte) []byte {
+	bz, fee := BeginMessage(nil, 1)
+	bz = AppendVarintField(bz, 1, 500)
+	bz = AppendStringField(bz, 2, "PHO")
+	bz = append(bz, feeExtra...)
+	bz = EndMessage(bz, fee)
+
+	bz, send := BeginMessage(bz, 2)
+	bz = AppendBytesField(bz, 1, []byte("12345678901234567890"))
+	bz = AppendBytesField(bz, 2, []byte{0x74, 0x23, 0x12, 0x63, 0x82})
+	bz, amount := BeginMessage(bz, 3)
+	bz = AppendVarintField(bz, 1, 18500)
+	bz = AppendStringField(bz, 2, denom)
+	bz = EndMessage(bz, amount)
+	return EndMessage(bz, send)
+}
+
+func TestSetPath(t *testing.T) {
+	bz, err := ioutil.ReadFile("testdata/send_msg.bin")
+	require.NoError(t, err)
+	orig := append([]byte{}, bz...)
+
+	// replace a nested string, with a longer one
+	res, err := SetPath(bz, AppendStringField(nil, 2, "ETHEREUM"), 2, 3, 2)
+	require.NoError(t, err)
+	assert.Equal(t, buildSendTx("ETHEREUM", nil), res)
+	// input is not touched
+	assert.Equal(t, orig, bz)
+
+	// long enough that the length prefixes grow
+	long := string(bytes.Repeat([]byte{'x'}, 300))
+	res, err = SetPath(bz, AppendStringField(nil, 2, long), 2, 3, 2)
+	require.NoError(t, err)
+	assert.Equal(t, buildSendTx(long, nil), res)
+
+	// insert a top level field
+	res, err = SetPath(bz, AppendVarintField(nil, 5, 7), 5)
+	require.NoError(t, err)
+	assert.Equal(t, AppendVarintField(orig, 5, 7), res)
+
+	// insert inside a missing message
+	res, err = SetPath(bz, AppendStringField(nil, 2, "NEW"), 3, 2, 2)
+	require.NoError(t, err)
+	assert.Equal(t, orig, res[:len(orig)])
+	raw, wire, err := ExtractPath(res, 3, 2, 2)
+	require.NoError(t, err)
+	assertString("NEW")(t, wire, raw)
+
+	// unknown fields are left in place
+	unknown := AppendVarintField(nil, 99, 12345)
+	withUnknown := buildSendTx("ATOM", unknown)
+	res, err = SetPath(withUnknown, AppendVarintField(nil, 1, 1), 1, 1)
+	require.NoError(t, err)
+	expected, fee := BeginMessage(nil, 1)
+	expected = AppendVarintField(expected, 1, 1)
+	expected = AppendStringField(expected, 2, "PHO")
+	expected = append(expected, unknown...)
+	expected = EndMessage(expected, fee)
+	assert.Equal(t, expected, res[:len(expected)])
+	// the send message after it is the same
+	tail := len(res) - len(expected)
+	assert.Equal(t, withUnknown[len(withUnknown)-tail:], res[len(expected):])
+}
+
+func TestSetPathDuplicates(t *testing.T) {
+	// Coin{2: "A", 2: "B"}, SetPath changes the last one
+	coin := AppendStringField(nil, 2, "A")
+	coin = AppendStringField(coin, 2, "B")
+	res, err := SetPath(coin, AppendStringField(nil, 2, "Z"), 2)
+	require.NoError(t, err)
+	assert.Equal(t, append(AppendStringField(nil, 2, "A"), AppendStringField(nil, 2, "Z")...), res)
+	// exclusive makes every reader see the new value
+	res, err = SetPathExclusive(coin, AppendStringField(nil, 2, "Z"), 2)
+	require.NoError(t, err)
+	assert.Equal(t, AppendStringField(nil, 2, "Z"), res)
+	raw, wire, err := ExtractField(res, 2)
+	require.NoError(t, err)
+	assertString("Z")(t, wire, raw)
+
+	bz, err := ioutil.ReadFile("testdata/send_msg.bin")
+	require.NoError(t, err)
+	// a second fee, with a denom
+	bz = append(bz, 0x0a, 5, 0x12, 3, 'N', 'E', 'W')
+
+	// the last one changed, the first one is untouched
+	res, err = SetPathExclusive(bz, AppendStringField(nil, 2, "SET"), 1, 2)
+	require.NoError(t, err)
+	raw, wire, err = ExtractMergedPath(res, 1, 2)
+	require.NoError(t, err)
+	assertString("SET")(t, wire, raw)
+	raw, wire, err = ExtractPath(res, 1, 2)
+	require.NoError(t, err)
+	assertString("PHO")(t, wire, raw)
+	assert.Equal(t, bz[:len(bz)-7], res[:len(bz)-7])
+
+	// the amount is only in the first fee, but we add to the last,
+	// which is still right after merging
+	res, err = SetPath(bz, AppendVarintField(nil, 1, 42), 1, 1)
+	require.NoError(t, err)
+	raw, wire, err = ExtractMergedPath(res, 1, 1)
+	require.NoError(t, err)
+	assertInt64(42)(t, wire, raw)
+
+	// exclusive on a message drops the copies that would be merged
+	fee := AppendBytesField(nil, 1, AppendVarintField(nil, 1, 7))
+	res, err = SetPathExclusive(bz, fee, 1)
+	require.NoError(t, err)
+	expected, err := RemoveAll(bz, 1)
+	require.NoError(t, err)
+	assert.Equal(t, append(expected, fee...), res)
+
+	// groups keep their markers
+	group := []byte{0x08, 5, 0x13, 0x0a, 2, 'i', 'n', 0x14, 0x20, 9}
+	res, err = SetPath(group, AppendStringField(nil, 1, "out"), 2, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x08, 5, 0x13, 0x0a, 3, 'o', 'u', 't', 0x14, 0x20, 9}, res)
+}
+
+func TestSetPathRepeated(t *testing.T) {
+	bz, err := ioutil.ReadFile("testdata/phonebook.bin")
+	require.NoError(t, err)
+	before, err := ExtractAll(bz, 2)
+	require.NoError(t, err)
+	require.Len(t, before, 3)
+
+	// only the last entry changes, the others are left byte for byte
+	for _, set := range []func([]byte, []byte, ...int32) ([]byte, error){SetPath, SetPathExclusive} {
+		res, err := set(bz, AppendStringField(nil, 1, "X"), 2, 1)
+		require.NoError(t, err)
+		after, err := ExtractAll(res, 2)
+		require.NoError(t, err)
+		require.Len(t, after, 3)
+		for i := 0; i < 2; i++ {
+			body, err := ParseBytesField(before[i].Raw)
+			require.NoError(t, err)
+			got, err := ParseBytesField(after[i].Raw)
+			require.NoError(t, err)
+			assert.Equal(t, body, got)
+		}
+		raw, wire, err := ExtractIndexedPath(res, At(2, 2), At(1, 0))
+		require.NoError(t, err)
+		assertString("X")(t, wire, raw)
+		raw, wire, err = ExtractIndexedPath(res, At(2, 2), At(2, 0))
+		require.NoError(t, err)
+		expected, _, err := ExtractIndexedPath(bz, At(2, 2), At(2, 0))
+		require.NoError(t, err)
+		str, err := ParseString(expected)
+		require.NoError(t, err)
+		assertString(str)(t, wire, raw)
+	}
+}
+
+func TestSetPathErrors(t *testing.T) {
+	bz, err := ioutil.ReadFile("testdata/send_msg.bin")
+	require.NoError(t, err)
+	value := AppendStringField(nil, 2, "X")
+
+	_, err = SetPath(bz, value)
+	assert.Error(t, err)
+	// value doesn't match path
+	_, err = SetPath(bz, value, 1, 1)
+	assert.Error(t, err)
+	// two fields in value
+	_, err = SetPath(bz, append(value, value...), 1, 2)
+	assert.Error(t, err)
+	// truncated value
+	_, err = SetPath(bz, value[:2], 1, 2)
+	assert.Error(t, err)
+	// cannot go into a scalar
+	_, err = SetPath(bz, value, 1, 1, 2)
+	assert.Error(t, err)
+	// bad data
+	_, err = SetPath(bz[:len(bz)-2], value, 2, 3, 2)
+	assert.Error(t, err)
+}
+
+func TestRemovePath(t *testing.T) {
+	bz, err := ioutil.ReadFile("testdata/send_msg.bin")
+	require.NoError(t, err)
+	orig := append([]byte{}, bz...)
+
+	// drop the denom inside the amount
+	res, err := RemovePath(bz, 2, 3, 2)
+	require.NoError(t, err)
+	assert.Equal(t, orig, bz)
+	_, _, err = ExtractPath(res, 2, 3, 2)
+	assert.True(t, IsNotFound(err))
+	raw, wire, err := ExtractPath(res, 2, 3, 1)
+	require.NoError(t, err)
+	assertInt64(18500)(t, wire, raw)
+	raw, wire, err = ExtractPath(res, 1, 2)
+	require.NoError(t, err)
+	assertString("PHO")(t, wire, raw)
+
+	// drop the whole fee, the rest is untouched
+	res, err = RemoveAll(bz, 1)
+	require.NoError(t, err)
+	send, _, err := ExtractField(bz, 2)
+	require.NoError(t, err)
+	assert.Equal(t, append([]byte{0x12}, send...), res)
+
+	// nothing there, nothing changes
+	res, err = RemovePath(bz, 3, 1)
+	require.NoError(t, err)
+	assert.Equal(t, orig, res)
+	res, err = RemoveAll(bz, 32)
+	require.NoError(t, err)
+	assert.Equal(t, orig, res)
+
+	// every occurrence goes, in every repeated message
+	pb, err := ioutil.ReadFile("testdata/phonebook.bin")
+	require.NoError(t, err)
+	res, err = RemovePath(pb, 2, 2)
+	require.NoError(t, err)
+	entries, err := ExtractAll(res, 2)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	for _, entry := range entries {
+		body, err := ParseBytesField(entry.Raw)
+		require.NoError(t, err)
+		has, err := HasField(body, 2)
+		require.NoError(t, err)
+		assert.False(t, has)
+		has, err = HasField(body, 1)
+		require.NoError(t, err)
+		assert.True(t, has)
+	}
+	raw, wire, err = ExtractField(res, 5)
+	require.NoError(t, err)
+	assertInt32(34)(t, wire, raw)
+
+	// inside groups
+	group := []byte{0x08, 5, 0x13, 0x0a, 2, 'i', 'n', 0x10, 1, 0x14, 0x20, 9}
+	res, err = RemovePath(group, 2, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x08, 5, 0x13, 0x10, 1, 0x14, 0x20, 9}, res)
+
+	// errors
+	_, err = RemovePath(bz)
+	assert.Error(t, err)
+	_, err = RemovePath(bz, 1, 1, 1)
+	assert.Error(t, err)
+	_, err = RemoveAll(bz[:len(bz)-1], 1)
+	assert.Error(t, err)
+}
+
+func TestKeepOnly(t *testing.T) {
+	bz, err := ioutil.ReadFile("testdata/phonebook.bin")
+	require.NoError(t, err)
+
+	res, err := KeepOnly(bz, 5, 1)
+	require.NoError(t, err)
+	expected := AppendStringField(nil, 1, "Friends")
+	expected = AppendVarintField(expected, 5, 34)
+	assert.Equal(t, expected, res)
+
+	// repeated fields are all kept
+	res, err = KeepOnly(bz, 2)
+	require.NoError(t, err)
+	count, err := CountField(res, 2)
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+	stripped, err := RemovePath(bz, 1)
+	require.NoError(t, err)
+	stripped, err = RemovePath(stripped, 3)
+	require.NoError(t, err)
+	stripped, err = RemovePath(stripped, 4)
+	require.NoError(t, err)
+	stripped, err = RemovePath(stripped, 5)
+	require.NoError(t, err)
+	assert.Equal(t, stripped, res)
+
+	res, err = KeepOnly(bz)
+	require.NoError(t, err)
+	assert.Empty(t, res)
+
+	_, err = KeepOnly(bz[:len(bz)-1], 1)
+	assert.Error(t, err)
+}
@@ -0,0 +1,160 @@
+package pbstream
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// The Append functions encode fields without reflection or
+// generated code, mirroring the Parse functions. Like the
+// append builtin, they add to bz and return the extended slice.
+//
+//	bz := AppendVarintField(nil, 1, 500)
+//	bz = AppendStringField(bz, 2, "PHO")
+
+// AppendVarint adds a raw varint, with no field header
+func AppendVarint(bz []byte, v uint64) []byte {
+	for v >= 0x80 {
+		bz = append(bz, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(bz, byte(v))
+}
+
+// AppendTag adds a field header
+func AppendTag(bz []byte, field int32, wireType int) []byte {
+	return AppendVarint(bz, uint64(field)<<3|uint64(wireType))
+}
+
+// AppendVarintField adds an int32, int64, uint32, uint64, bool
+// or enum field. Negative int32 and int64 must be passed as
+// uint64(int64(v)), which takes 10 bytes, as protobuf does.
+func AppendVarintField(bz []byte, field int32, v uint64) []byte {
+	bz = AppendTag(bz, field, WireVarint)
+	return AppendVarint(bz, v)
+}
+
+// AppendSintField adds a sint32 or sint64 field
+func AppendSintField(bz []byte, field int32, v int64) []byte {
+	return AppendVarintField(bz, field, PackSint(v))
+}
+
+// AppendFixed32Field adds a fixed32 or sfixed32 field
+func AppendFixed32Field(bz []byte, field int32, v uint32) []byte {
+	bz = AppendTag(bz, field, WireFixed32)
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(bz, buf[:]...)
+}
+
+// AppendFixed64Field adds a fixed64 or sfixed64 field
+func AppendFixed64Field(bz []byte, field int32, v uint64) []byte {
+	bz = AppendTag(bz, field, WireFixed64)
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return append(bz, buf[:]...)
+}
+
+// AppendFloat adds a float field
+func AppendFloat(bz []byte, field int32, v float32) []byte {
+	return AppendFixed32Field(bz, field, math.Float32bits(v))
+}
+
+// AppendDouble adds a double field
+func AppendDouble(bz []byte, field int32, v float64) []byte {
+	return AppendFixed64Field(bz, field, math.Float64bits(v))
+}
+
+// AppendBytesField adds a bytes field, or an embedded message
+// that was already encoded
+func AppendBytesField(bz []byte, field int32, v []byte) []byte {
+	bz = AppendTag(bz, field, WireLengthPrefix)
+	bz = AppendVarint(bz, uint64(len(v)))
+	return append(bz, v...)
+}
+
+// AppendStringField adds a string field
+func AppendStringField(bz []byte, field int32, v string) []byte {
+	bz = AppendTag(bz, field, WireLengthPrefix)
+	bz = AppendVarint(bz, uint64(len(v)))
+	return append(bz, v...)
+}
+
+// AppendPacked adds a packed repeated field, where wire is the
+// encoding of each number (WireVarint, WireFixed64, WireFixed32),
+// as for ParsePackedRepeated. Use PackSint for sint values.
+func AppendPacked(bz []byte, field int32, wire int, vals []uint64) []byte {
+	var size int
+	switch wire {
+	case WireFixed32, WireFixed64:
+		size = len(vals) * fixedWidth(wire)
+	default:
+		for _, v := range vals {
+			size += varintSize(v)
+		}
+	}
+
+	bz = AppendTag(bz, field, WireLengthPrefix)
+	bz = AppendVarint(bz, uint64(size))
+	for _, v := range vals {
+		switch wire {
+		case WireFixed32:
+			var buf [4]byte
+			binary.LittleEndian.PutUint32(buf[:], uint32(v))
+			bz = append(bz, buf[:]...)
+		case WireFixed64:
+			var buf [8]byte
+			binary.LittleEndian.PutUint64(buf[:], v)
+			bz = append(bz, buf[:]...)
+		default:
+			bz = AppendVarint(bz, v)
+		}
+	}
+	return bz
+}
+
+// BeginMessage starts an embedded message in the given field.
+// Append its fields, then call EndMessage with the returned mark
+// to fill in the length. Messages may be nested.
+//
+//	bz, mark := BeginMessage(bz, 1)
+//	bz = AppendVarintField(bz, 1, 500)
+//	bz = AppendStringField(bz, 2, "PHO")
+//	bz = EndMessage(bz, mark)
+func BeginMessage(bz []byte, field int32) ([]byte, int) {
+	bz = AppendTag(bz, field, WireLengthPrefix)
+	// reserve one byte for the length, most messages are small
+	bz = append(bz, 0)
+	return bz, len(bz)
+}
+
+// EndMessage closes the message opened with BeginMessage, writing
+// its length before the body, and moving the body if the length
+// needs more than one byte.
+func EndMessage(bz []byte, mark int) []byte {
+	size := len(bz) - mark
+	n := varintSize(uint64(size))
+	if n > 1 {
+		// make room for the longer length
+		bz = append(bz, make([]byte, n-1)...)
+		copy(bz[mark+n-1:], bz[mark:mark+size])
+	}
+	AppendVarint(bz[:mark-1], uint64(size))
+	return bz
+}
+
+// PackSint encodes a signed number the way sint32 and sint64
+// are stored (zigzag), the reverse of UnpackSint
+func PackSint(v int64) uint64 {
+	return uint64(v<<1) ^ uint64(v>>63)
+}
+
+// varintSize is the number of bytes AppendVarint uses
+func varintSize(v uint64) int {
+	n := 1
+	for v >= 0x80 {
+		v >>= 7
+		n++
+	}
+	return n
+}
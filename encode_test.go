@@ -0,0 +1,156 @@
+package pbstream
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// negative converts a signed number to the raw value on the wire
+func negative(v int64) uint64 {
+	return uint64(v)
+}
+
+func TestPackSint(t *testing.T) {
+	cases := []int64{0, -1, 1, -2, 2147483647, -2147483648, math.MaxInt64, math.MinInt64}
+	for _, tc := range cases {
+		assert.Equal(t, tc, UnpackSint(PackSint(tc)))
+	}
+	assert.Equal(t, uint64(3), PackSint(-2))
+}
+
+// the encoders must produce the same bytes as gogo/protobuf,
+// see _gen/cmd/gen.go for the source of the test data
+func TestAppendMatchesProtobuf(t *testing.T) {
+	cases := []struct {
+		pbfile string
+		build  func() []byte
+	}{
+		{
+			"testdata/person_john.bin",
+			func() []byte {
+				bz := AppendStringField(nil, 1, "John")
+				bz = AppendVarintField(bz, 2, 123)
+				return AppendStringField(bz, 3, "john@doe.com")
+			},
+		},
+		{
+			"testdata/employee_marmot.bin",
+			func() []byte {
+				bz := AppendStringField(nil, 1, "COO")
+				bz, mark := BeginMessage(bz, 2)
+				bz = AppendStringField(bz, 1, "Mr. Marmot")
+				bz = AppendVarintField(bz, 2, negative(-37))
+				return EndMessage(bz, mark)
+			},
+		},
+		{
+			"testdata/mixed.bin",
+			func() []byte {
+				bz := AppendFloat(nil, 1, 1.234)
+				bz = AppendDouble(bz, 2, -56.78)
+				bz = AppendVarintField(bz, 3, 654321)
+				bz = AppendVarintField(bz, 4, negative(-8877665544332211))
+				bz = AppendVarintField(bz, 5, 87654)
+				bz = AppendVarintField(bz, 6, 1122334455667788)
+				bz = AppendSintField(bz, 7, 162)
+				bz = AppendSintField(bz, 8, -835)
+				bz = AppendFixed32Field(bz, 9, 19734562)
+				bz = AppendFixed64Field(bz, 10, 2926733)
+				bz = AppendFixed32Field(bz, 11, uint32(negative(-38919)))
+				bz = AppendFixed64Field(bz, 12, 20472732987)
+				bz = AppendVarintField(bz, 13, 1)
+				bz = AppendStringField(bz, 14, "Hello")
+				bz = AppendBytesField(bz, 15, []byte{17, 32, 16, 0, 4})
+				return AppendVarintField(bz, 16, 3)
+			},
+		},
+		{
+			"testdata/phonebook.bin",
+			func() []byte {
+				bz := AppendStringField(nil, 1, "Friends")
+				for _, p := range [][2]string{{"John", "123-4567"}, {"Jane", "444-1234"}, {"Sammy", "55-666-7777"}} {
+					var mark int
+					bz, mark = BeginMessage(bz, 2)
+					bz = AppendStringField(bz, 1, p[0])
+					bz = AppendStringField(bz, 2, p[1])
+					bz = EndMessage(bz, mark)
+				}
+				random := []int64{532, -344, 3454230, 543, -234}
+				vals := make([]uint64, len(random))
+				for i, r := range random {
+					vals[i] = uint64(r)
+				}
+				bz = AppendPacked(bz, 3, WireVarint, vals)
+				bz = AppendPacked(bz, 4, WireFixed32, []uint64{123, 4567, 846273})
+				return AppendVarintField(bz, 5, 34)
+			},
+		},
+		{
+			"testdata/send_msg.bin",
+			func() []byte {
+				bz, fee := BeginMessage(nil, 1)
+				bz = AppendVarintField(bz, 1, 500)
+				bz = AppendStringField(bz, 2, "PHO")
+				bz = EndMessage(bz, fee)
+
+				bz, send := BeginMessage(bz, 2)
+				bz = AppendBytesField(bz, 1, []byte("12345678901234567890"))
+				bz = AppendBytesField(bz, 2, []byte{0x74, 0x23, 0x12, 0x63, 0x82})
+				bz, amount := BeginMessage(bz, 3)
+				bz = AppendVarintField(bz, 1, 18500)
+				bz = AppendStringField(bz, 2, "ATOM")
+				bz = EndMessage(bz, amount)
+				return EndMessage(bz, send)
+			},
+		},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case-%d", i), func(t *testing.T) {
+			expected, err := ioutil.ReadFile(tc.pbfile)
+			require.NoError(t, err)
+			assert.Equal(t, expected, tc.build())
+		})
+	}
+}
+
+func TestEndMessageLarge(t *testing.T) {
+	// length needs three bytes, and an inner message needs two
+	long := bytes.Repeat([]byte{'x'}, 20000)
+	bz := AppendVarintField(nil, 1, 7)
+	bz, outer := BeginMessage(bz, 2)
+	bz, inner := BeginMessage(bz, 3)
+	bz = AppendBytesField(bz, 1, long[:200])
+	bz = EndMessage(bz, inner)
+	bz = AppendBytesField(bz, 4, long)
+	bz = EndMessage(bz, outer)
+	bz = AppendSintField(bz, 5, -5)
+
+	raw, wire, err := ExtractPath(bz, 2, 3, 1)
+	require.NoError(t, err)
+	assertBytes(long[:200])(t, wire, raw)
+	raw, wire, err = ExtractPath(bz, 2, 4)
+	require.NoError(t, err)
+	assertBytes(long)(t, wire, raw)
+	raw, wire, err = ExtractPath(bz, 5)
+	require.NoError(t, err)
+	assertSint64(-5)(t, wire, raw)
+
+	// packed varints and fixed64 round trip
+	vals := []uint64{0, 1, 300, math.MaxUint64}
+	bz = AppendPacked(nil, 1, WireVarint, vals)
+	bz = AppendPacked(bz, 2, WireFixed64, vals)
+	for field, wire := range map[int32]int{1: WireVarint, 2: WireFixed64} {
+		raw, _, err := ExtractField(bz, field)
+		require.NoError(t, err)
+		got, err := ParsePackedRepeated(wire, raw)
+		require.NoError(t, err)
+		assert.Equal(t, vals, got)
+	}
+}
@@ -0,0 +1,282 @@
+package pbstream
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// EventType says what kind of event the EventParser found
+type EventType int
+
+const (
+	// EventStartMessage is emitted when we descend into an embedded
+	// message or group. Raw is the whole field.
+	EventStartMessage EventType = iota + 1
+	// EventEndMessage is emitted when the embedded message or group
+	// is finished. FieldNum is that of the message.
+	EventEndMessage
+	// EventScalar is a varint or fixed field. Parse Raw with ParseAnyInt.
+	EventScalar
+	// EventBytes is a length prefixed field we did not descend into.
+	// Bytes is the payload, Raw still has the length prefix.
+	EventBytes
+)
+
+// EventParser is a pull parser that emits one event per field,
+// like a SAX parser for protobuf. Without a schema, we cannot tell
+// an embedded message from a string, so the caller registers the
+// paths of the fields to descend into with Descend. Groups are
+// self-describing and always descended into.
+//
+// After setup, parsing does not allocate, and all data returned
+// points into the original buffer.
+//
+//	p := NewEventParser(bz)
+//	p.Descend(2)
+//	for p.Next() {
+//		switch p.Type() {
+//		case EventStartMessage:
+//			...
+//		case EventScalar:
+//			val, _, err := ParseAnyInt(p.WireType(), p.Raw())
+//		}
+//	}
+//	if err := p.Err(); err != nil {
+//		...
+//	}
+type EventParser struct {
+	bz      []byte
+	pos     int
+	descend [][]int32
+
+	// stack of open messages, path has their field numbers
+	frames []eventFrame
+	path   []int32
+
+	// the current event
+	typ      EventType
+	depth    int
+	fieldNum int32
+	wireType int
+	raw      []byte
+	data     []byte
+
+	err error
+}
+
+type eventFrame struct {
+	// limit is the end of the innermost length prefixed message,
+	// the payload of this one, or of the parent for groups
+	limit int
+	group bool
+}
+
+// NewEventParser returns a parser positioned before the first
+// field of bz.
+func NewEventParser(bz []byte) *EventParser {
+	return &EventParser{
+		bz:     bz,
+		frames: make([]eventFrame, 0, 8),
+		path:   make([]int32, 0, 8),
+	}
+}
+
+// Descend registers a path of field numbers (from the top level)
+// that holds an embedded message, which the parser should go into
+// rather than emitting it as EventBytes. The parent fields must be
+// registered as well. Repeated fields descend into every element.
+func (p *EventParser) Descend(path ...int32) {
+	p.descend = append(p.descend, append([]int32(nil), path...))
+}
+
+// Reset starts parsing a new buffer with the same Descend paths
+func (p *EventParser) Reset(bz []byte) {
+	p.bz, p.pos, p.err = bz, 0, nil
+	p.frames, p.path = p.frames[:0], p.path[:0]
+	p.typ, p.depth, p.fieldNum, p.wireType, p.raw, p.data = 0, 0, 0, 0, nil, nil
+}
+
+// Next advances to the next event, returning false at the end of
+// the buffer or if the data is malformed (check Err).
+func (p *EventParser) Next() bool {
+	if p.err != nil {
+		return false
+	}
+	p.raw, p.data = nil, nil
+
+	// close an embedded message we finished
+	if n := len(p.frames); n > 0 && !p.frames[n-1].group && p.pos == p.frames[n-1].limit {
+		p.pop(n - 1)
+		return true
+	}
+	limit := p.limit()
+	if p.pos >= limit {
+		if len(p.frames) > 0 {
+			// only a group can still be open
+			p.err = errors.WithStack(io.ErrUnexpectedEOF)
+		}
+		return false
+	}
+
+	bz := p.bz[p.pos:limit]
+	offset, fieldNum, wireType, err := parseFieldHeader(bz)
+	if err != nil {
+		p.err = err
+		return false
+	}
+	p.fieldNum, p.wireType, p.depth = fieldNum, wireType, len(p.frames)
+
+	switch wireType {
+	case WireBeginGroup:
+		if len(p.frames) >= MaxNestingDepth {
+			p.err = errors.Errorf("Messages nested deeper than %d", MaxNestingDepth)
+			return false
+		}
+		p.pos += offset
+		// groups end with a marker, so keep the parent's limit
+		p.push(fieldNum, eventFrame{limit: limit, group: true})
+		p.typ = EventStartMessage
+		return true
+	case WireEndGroup:
+		n := len(p.frames)
+		if n == 0 || !p.frames[n-1].group || p.path[n-1] != fieldNum {
+			p.err = errors.Errorf("proto: unexpected end group %d", fieldNum)
+			return false
+		}
+		p.pos += offset
+		p.pop(n - 1)
+		return true
+	}
+
+	size, err := skipField(bz)
+	if err != nil {
+		p.err = err
+		return false
+	}
+	if size < 0 || size > len(bz) {
+		p.err = errors.WithStack(io.ErrUnexpectedEOF)
+		return false
+	}
+	p.raw = bz[offset:size]
+
+	if wireType != WireLengthPrefix {
+		p.typ = EventScalar
+		p.pos += size
+		return true
+	}
+
+	p.data, err = ParseBytesField(p.raw)
+	if err != nil {
+		p.err = err
+		return false
+	}
+	if !p.shouldDescend(fieldNum) {
+		p.typ = EventBytes
+		p.pos += size
+		return true
+	}
+	if len(p.frames) >= MaxNestingDepth {
+		p.err = errors.Errorf("Messages nested deeper than %d", MaxNestingDepth)
+		return false
+	}
+	p.typ = EventStartMessage
+	p.push(fieldNum, eventFrame{limit: p.pos + size})
+	// continue at the start of the payload
+	p.pos += size - len(p.data)
+	return true
+}
+
+// limit is where the innermost length prefixed message ends
+func (p *EventParser) limit() int {
+	if n := len(p.frames); n > 0 {
+		return p.frames[n-1].limit
+	}
+	return len(p.bz)
+}
+
+func (p *EventParser) push(fieldNum int32, frame eventFrame) {
+	p.frames = append(p.frames, frame)
+	p.path = append(p.path, fieldNum)
+}
+
+// pop closes the message at index n and sets the EndMessage event
+func (p *EventParser) pop(n int) {
+	p.typ = EventEndMessage
+	p.depth = n
+	p.fieldNum = p.path[n]
+	if p.frames[n].group {
+		p.wireType = WireBeginGroup
+	} else {
+		p.wireType = WireLengthPrefix
+	}
+	p.frames, p.path = p.frames[:n], p.path[:n]
+}
+
+// shouldDescend checks if the current path plus fieldNum
+// was registered with Descend
+func (p *EventParser) shouldDescend(fieldNum int32) bool {
+	for _, d := range p.descend {
+		if len(d) != len(p.path)+1 || d[len(p.path)] != fieldNum {
+			continue
+		}
+		match := true
+		for i, f := range p.path {
+			if d[i] != f {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// Type returns the kind of the current event
+func (p *EventParser) Type() EventType {
+	return p.typ
+}
+
+// FieldNum returns the field number the current event is about
+func (p *EventParser) FieldNum() int32 {
+	return p.fieldNum
+}
+
+// WireType returns the encoding of the field for the current event
+func (p *EventParser) WireType() int {
+	return p.wireType
+}
+
+// Raw returns the bytes of the field after the header, in the same
+// form that ExtractField returns them. It is nil for EndMessage
+// and for groups.
+func (p *EventParser) Raw() []byte {
+	return p.raw
+}
+
+// Bytes returns the payload of a length prefixed field, for
+// EventBytes and EventStartMessage (the body of the message).
+func (p *EventParser) Bytes() []byte {
+	return p.data
+}
+
+// Depth returns how many messages enclose the current field
+// (0 for top level fields). For EventStartMessage and EventEndMessage
+// this is the depth of the embedded message field itself.
+func (p *EventParser) Depth() int {
+	return p.depth
+}
+
+// Path returns the field numbers of the messages enclosing the
+// current field, with length Depth. It is only valid until the
+// next call to Next.
+func (p *EventParser) Path() []int32 {
+	return p.path[:p.depth]
+}
+
+// Err returns the error that stopped the parser, if any.
+func (p *EventParser) Err() error {
+	return p.err
+}
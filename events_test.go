@@ -0,0 +1,156 @@
+package pbstream
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// describe turns all events into a string to compare
+func describe(p *EventParser) string {
+	var events []string
+	for p.Next() {
+		prefix := strings.Repeat(" ", p.Depth())
+		switch p.Type() {
+		case EventStartMessage:
+			events = append(events, fmt.Sprintf("%s%d{", prefix, p.FieldNum()))
+		case EventEndMessage:
+			events = append(events, fmt.Sprintf("%s}%d", prefix, p.FieldNum()))
+		case EventScalar:
+			val, _, _ := ParseAnyInt(p.WireType(), p.Raw())
+			events = append(events, fmt.Sprintf("%s%d=%d", prefix, p.FieldNum(), val))
+		case EventBytes:
+			events = append(events, fmt.Sprintf("%s%d=%q", prefix, p.FieldNum(), p.Bytes()))
+		}
+	}
+	return strings.Join(events, "\n")
+}
+
+func TestEventParser(t *testing.T) {
+	bz, err := ioutil.ReadFile("testdata/send_msg.bin")
+	require.NoError(t, err)
+
+	// without hints, all embedded structs are bytes
+	p := NewEventParser(bz)
+	var fields []int32
+	for p.Next() {
+		assert.Equal(t, EventBytes, p.Type())
+		assert.Equal(t, 0, p.Depth())
+		fields = append(fields, p.FieldNum())
+	}
+	require.NoError(t, p.Err())
+	assert.Equal(t, []int32{1, 2}, fields)
+
+	p = NewEventParser(bz)
+	p.Descend(1)
+	p.Descend(2)
+	p.Descend(2, 3)
+	expected := `1{
+ 1=500
+ 2="PHO"
+}1
+2{
+ 1="12345678901234567890"
+ 2="t#\x12c\x82"
+ 3{
+  1=18500
+  2="ATOM"
+ }3
+}2`
+	assert.Equal(t, expected, describe(p))
+	require.NoError(t, p.Err())
+
+	// only descend into the send msg, not the fee
+	p = NewEventParser(bz)
+	p.Descend(2)
+	p.Descend(2, 3)
+	var paths []string
+	for p.Next() {
+		if p.Type() == EventScalar {
+			paths = append(paths, fmt.Sprintf("%v:%d", p.Path(), p.FieldNum()))
+		}
+	}
+	require.NoError(t, p.Err())
+	assert.Equal(t, []string{"[2 3]:1"}, paths)
+}
+
+func TestEventParserRepeated(t *testing.T) {
+	bz, err := ioutil.ReadFile("testdata/phonebook.bin")
+	require.NoError(t, err)
+
+	p := NewEventParser(bz)
+	p.Descend(2)
+	var names []string
+	for p.Next() {
+		if p.Type() == EventBytes && p.Depth() == 1 && p.FieldNum() == 1 {
+			names = append(names, string(p.Bytes()))
+		}
+	}
+	require.NoError(t, p.Err())
+	assert.Equal(t, []string{"John", "Jane", "Sammy"}, names)
+
+	// no allocations after setup
+	allocs := testing.AllocsPerRun(10, func() {
+		p.Reset(bz)
+		for p.Next() {
+		}
+	})
+	assert.Equal(t, 0.0, allocs)
+}
+
+func TestEventParserGroups(t *testing.T) {
+	// {1: 5, group 2 {1: {1: 6}, group 3 {1: 7}}, 4: 9}
+	bz := []byte{0x08, 5, 0x13, 0x0a, 2, 0x08, 6, 0x1b, 0x08, 7, 0x1c, 0x14, 0x20, 9}
+	p := NewEventParser(bz)
+	p.Descend(2, 1)
+	expected := `1=5
+2{
+ 1{
+  1=6
+ }1
+ 3{
+  1=7
+ }3
+}2
+4=9`
+	assert.Equal(t, expected, describe(p))
+	require.NoError(t, p.Err())
+
+	bad := map[string][]byte{
+		"unterminated":       {0x13, 0x08, 1},
+		"wrong end":          {0x13, 0x08, 1, 0x1c},
+		"group past message": {0x0a, 3, 0x13, 0x08, 1, 0x14},
+		"truncated":          {0x0a, 5, 0x08, 1},
+	}
+	for name, bz := range bad {
+		t.Run(name, func(t *testing.T) {
+			p := NewEventParser(bz)
+			p.Descend(1)
+			for p.Next() {
+			}
+			assert.Error(t, p.Err())
+		})
+	}
+
+	// deep nesting is fine up to the limit
+	p = NewEventParser(nestedGroups(MaxNestingDepth))
+	var events, maxDepth int
+	for p.Next() {
+		events++
+		if p.Depth() > maxDepth {
+			maxDepth = p.Depth()
+		}
+	}
+	require.NoError(t, p.Err())
+	assert.Equal(t, 2*MaxNestingDepth+1, events)
+	assert.Equal(t, MaxNestingDepth-1, maxDepth)
+
+	p = NewEventParser(nestedGroups(MaxNestingDepth + 1))
+	for p.Next() {
+	}
+	assert.Error(t, p.Err())
+}
@@ -0,0 +1,143 @@
+package pbstream
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// grpcHeaderLen is the compressed flag plus a 4 byte length
+const grpcHeaderLen = 5
+
+// GRPCReader reads the messages in a gRPC HTTP/2 body.
+// Each message is framed as a compressed-flag byte, a 4-byte
+// big-endian length, then the protobuf bytes. Compressed frames
+// are assumed to use gzip (the only standard grpc-encoding).
+//
+// The payloads are ready to pass to ExtractField or ExtractPath.
+type GRPCReader struct {
+	r      io.Reader
+	max    int
+	header [grpcHeaderLen]byte
+	buf    bytes.Buffer
+	out    bytes.Buffer
+}
+
+// NewGRPCReader reads frames from r
+func NewGRPCReader(r io.Reader) *GRPCReader {
+	return &GRPCReader{r: r, max: DefaultMaxMessageSize}
+}
+
+// SetMaxSize sets the largest message we accept, both for the
+// frame on the wire and after decompression.
+func (g *GRPCReader) SetMaxSize(max int) {
+	g.max = max
+}
+
+// ReadMessage returns the (decompressed) payload of the next frame.
+// It returns io.EOF when the body ends cleanly between frames.
+// The data is only valid until the next call.
+func (g *GRPCReader) ReadMessage() ([]byte, error) {
+	if _, err := io.ReadFull(g.r, g.header[:]); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, unexpectedEOF(err)
+	}
+	compressed := g.header[0]
+	size := binary.BigEndian.Uint32(g.header[1:])
+	if compressed > 1 {
+		return nil, errors.Errorf("Invalid gRPC compressed flag %d", compressed)
+	}
+	if uint64(size) > uint64(g.max) {
+		return nil, errors.Errorf("Message of %d bytes larger than max size %d", size, g.max)
+	}
+
+	if err := readSized(&g.buf, g.r, int64(size)); err != nil {
+		return nil, err
+	}
+	if compressed == 0 {
+		return g.buf.Bytes(), nil
+	}
+	return g.decompress()
+}
+
+func (g *GRPCReader) decompress() ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(g.buf.Bytes()))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	g.out.Reset()
+	// read one more than allowed, to catch anything too big
+	n, err := g.out.ReadFrom(io.LimitReader(zr, int64(g.max)+1))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if n > int64(g.max) {
+		return nil, errors.Errorf("Decompressed message larger than max size %d", g.max)
+	}
+	if err := zr.Close(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return g.out.Bytes(), nil
+}
+
+// GRPCWriter writes messages in gRPC frames, to be read
+// by GRPCReader or a gRPC server.
+type GRPCWriter struct {
+	w      io.Writer
+	header [grpcHeaderLen]byte
+	zbuf   bytes.Buffer
+	zw     *gzip.Writer
+}
+
+// NewGRPCWriter writes frames to w
+func NewGRPCWriter(w io.Writer) *GRPCWriter {
+	return &GRPCWriter{w: w}
+}
+
+// WriteMessage writes one frame with msg as the payload.
+// If compress is true, the payload is gzipped and flagged
+// as compressed.
+func (g *GRPCWriter) WriteMessage(msg []byte, compress bool) error {
+	g.header[0] = 0
+	if compress {
+		var err error
+		msg, err = g.compress(msg)
+		if err != nil {
+			return err
+		}
+		g.header[0] = 1
+	}
+	if uint64(len(msg)) > 1<<32-1 {
+		return errors.Errorf("Message of %d bytes too large for gRPC", len(msg))
+	}
+
+	binary.BigEndian.PutUint32(g.header[1:], uint32(len(msg)))
+	if _, err := g.w.Write(g.header[:]); err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := g.w.Write(msg); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func (g *GRPCWriter) compress(msg []byte) ([]byte, error) {
+	g.zbuf.Reset()
+	if g.zw == nil {
+		g.zw = gzip.NewWriter(&g.zbuf)
+	} else {
+		g.zw.Reset(&g.zbuf)
+	}
+	if _, err := g.zw.Write(msg); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err := g.zw.Close(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return g.zbuf.Bytes(), nil
+}
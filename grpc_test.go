@@ -0,0 +1,106 @@
+package pbstream
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGRPCFrames(t *testing.T) {
+	send, err := ioutil.ReadFile("testdata/send_msg.bin")
+	require.NoError(t, err)
+	issue, err := ioutil.ReadFile("testdata/issue_msg.bin")
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	w := NewGRPCWriter(&buf)
+	require.NoError(t, w.WriteMessage(send, false))
+	require.NoError(t, w.WriteMessage(issue, true))
+	require.NoError(t, w.WriteMessage(send, true))
+	body := buf.Bytes()
+
+	// first frame is uncompressed, as on the wire
+	assert.Equal(t, []byte{0, 0, 0, 0, byte(len(send))}, body[:5])
+	assert.Equal(t, send, body[5:5+len(send)])
+	// second is flagged
+	assert.Equal(t, byte(1), body[5+len(send)])
+
+	r := NewGRPCReader(iotest.HalfReader(bytes.NewReader(body)))
+	var denoms []string
+	for {
+		msg, err := r.ReadMessage()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		raw, _, err := ExtractPath(msg, 1, 2)
+		require.NoError(t, err)
+		denom, err := ParseString(raw)
+		require.NoError(t, err)
+		denoms = append(denoms, denom)
+	}
+	assert.Equal(t, []string{"PHO", "SPC", "PHO"}, denoms)
+}
+
+func TestGRPCReaderErrors(t *testing.T) {
+	send, err := ioutil.ReadFile("testdata/send_msg.bin")
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	w := NewGRPCWriter(&buf)
+	require.NoError(t, w.WriteMessage(send, false))
+	plain := append([]byte{}, buf.Bytes()...)
+	buf.Reset()
+	big := bytes.Repeat([]byte{0x08, 1}, 5000)
+	require.NoError(t, w.WriteMessage(big, true))
+	zipped := append([]byte{}, buf.Bytes()...)
+
+	// truncated header and body
+	_, err = NewGRPCReader(bytes.NewReader(plain[:3])).ReadMessage()
+	assert.Equal(t, io.ErrUnexpectedEOF, errors.Cause(err))
+	_, err = NewGRPCReader(bytes.NewReader(plain[:10])).ReadMessage()
+	assert.Equal(t, io.ErrUnexpectedEOF, errors.Cause(err))
+
+	// bad flag
+	bad := append([]byte{}, plain...)
+	bad[0] = 7
+	_, err = NewGRPCReader(bytes.NewReader(bad)).ReadMessage()
+	assert.Error(t, err)
+
+	// compressed flag, but not gzip
+	bad[0] = 1
+	_, err = NewGRPCReader(bytes.NewReader(bad)).ReadMessage()
+	assert.Error(t, err)
+
+	// frame too big
+	r := NewGRPCReader(bytes.NewReader(plain))
+	r.SetMaxSize(10)
+	_, err = r.ReadMessage()
+	assert.Error(t, err)
+
+	// small on the wire, too big once decompressed
+	require.True(t, len(zipped) < 1000)
+	r = NewGRPCReader(bytes.NewReader(zipped))
+	r.SetMaxSize(1000)
+	_, err = r.ReadMessage()
+	assert.Error(t, err)
+	r = NewGRPCReader(bytes.NewReader(zipped))
+	msg, err := r.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, big, msg)
+}
+
+func TestGRPCReaderBogusLength(t *testing.T) {
+	// claims 60 MB, but only has a few bytes
+	bogus := []byte{0, 0x03, 0xc0, 0, 0, 'a', 'b', 'c'}
+	used := allocated(func() {
+		_, err := NewGRPCReader(bytes.NewReader(bogus)).ReadMessage()
+		assert.Equal(t, io.ErrUnexpectedEOF, errors.Cause(err))
+	})
+	assert.True(t, used < 1<<20, "allocated %d bytes", used)
+}
@@ -0,0 +1,106 @@
+package pbstream
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// FieldIterator walks over every top-level field of a message
+// in wire order, without allocating or copying any data.
+//
+// Usage:
+//
+//	it := NewFieldIterator(bz)
+//	for it.Next() {
+//		if it.FieldNum() == 1 {
+//			name, err := ParseString(it.Raw())
+//			...
+//		}
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type FieldIterator struct {
+	bz []byte
+	// pos is the start of the next field to parse
+	pos int
+
+	// information on the current field
+	start    int
+	header   int
+	fieldNum int32
+	wireType int
+
+	err error
+}
+
+// NewFieldIterator returns an iterator positioned before the
+// first field of bz. Call Next to advance to each field.
+func NewFieldIterator(bz []byte) FieldIterator {
+	return FieldIterator{bz: bz}
+}
+
+// Next advances to the next field, returning false when there
+// are no more fields or the data was malformed (check Err).
+func (f *FieldIterator) Next() bool {
+	if f.err != nil || f.pos >= len(f.bz) {
+		return false
+	}
+	bz := f.bz[f.pos:]
+
+	offset, fieldNum, wireType, err := parseFieldHeader(bz)
+	if err != nil {
+		f.err = err
+		return false
+	}
+	skippy, err := skipField(bz)
+	if err != nil {
+		f.err = err
+		return false
+	}
+	if skippy < 0 {
+		f.err = errors.WithStack(ErrInvalidLengthSample)
+		return false
+	}
+	if skippy > len(bz) {
+		f.err = errors.WithStack(io.ErrUnexpectedEOF)
+		return false
+	}
+
+	f.start = f.pos
+	f.header = offset
+	f.fieldNum = fieldNum
+	f.wireType = wireType
+	f.pos += skippy
+	return true
+}
+
+// FieldNum returns the field number of the current field
+func (f *FieldIterator) FieldNum() int32 {
+	return f.fieldNum
+}
+
+// WireType returns the encoding of the current field
+func (f *FieldIterator) WireType() int {
+	return f.wireType
+}
+
+// Raw returns the bytes of the current field after the header,
+// in the same form that ExtractField returns them. It can be
+// passed directly to ParseAnyInt, ParseBytesField, etc.
+func (f *FieldIterator) Raw() []byte {
+	return f.bz[f.start+f.header : f.pos]
+}
+
+// Offset returns the position of the header of the current
+// field, relative to the start of the buffer being iterated.
+func (f *FieldIterator) Offset() int {
+	return f.start
+}
+
+// Err returns the error that stopped the iteration, if any.
+// It is nil if we stopped at the end of the buffer.
+func (f *FieldIterator) Err() error {
+	return f.err
+}
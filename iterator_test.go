@@ -0,0 +1,62 @@
+package pbstream
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFieldIterator(t *testing.T) {
+	bz, err := ioutil.ReadFile("testdata/phonebook.bin")
+	require.NoError(t, err)
+
+	var fields []int32
+	var wires []int
+	it := NewFieldIterator(bz)
+	for it.Next() {
+		fields = append(fields, it.FieldNum())
+		wires = append(wires, it.WireType())
+
+		// raw must be what ExtractField would give us for the first match
+		if it.FieldNum() == 1 {
+			assertString("Friends")(t, it.WireType(), it.Raw())
+			assert.Equal(t, 0, it.Offset())
+		}
+		if it.FieldNum() == 5 {
+			assertInt32(34)(t, it.WireType(), it.Raw())
+		}
+	}
+	require.NoError(t, it.Err())
+
+	assert.Equal(t, []int32{1, 2, 2, 2, 3, 4, 5}, fields)
+	assert.Equal(t, []int{2, 2, 2, 2, 2, 2, 0}, wires)
+}
+
+func TestFieldIteratorErrors(t *testing.T) {
+	// empty buffer is fine, just no fields
+	it := NewFieldIterator(nil)
+	assert.False(t, it.Next())
+	assert.NoError(t, it.Err())
+
+	cases := map[string][]byte{
+		// field 1, string of length 5, only 2 bytes
+		"truncated bytes": {0x0a, 0x05, 'h', 'i'},
+		// field 1, fixed64, only 3 bytes
+		"truncated fixed": {0x09, 1, 2, 3},
+		// varint header never terminates
+		"bad header": {0x80, 0x80},
+		// field 0 is illegal
+		"zero field": {0x00, 0x01},
+	}
+	for name, bz := range cases {
+		t.Run(name, func(t *testing.T) {
+			it := NewFieldIterator(bz)
+			assert.False(t, it.Next())
+			assert.Error(t, it.Err())
+			// and we stay stopped
+			assert.False(t, it.Next())
+		})
+	}
+}
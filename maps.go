@@ -0,0 +1,196 @@
+package pbstream
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+)
+
+// MapIterator walks over the entries of a map<K,V> field.
+//
+// Maps are encoded as a repeated embedded message, where
+// each entry has the key in field 1 and the value in field 2.
+// Entries are returned in wire order, so duplicate keys
+// will show up more than once (the last one wins).
+type MapIterator struct {
+	field   int32
+	entries FieldIterator
+
+	key     []byte
+	keyWire int
+	value   []byte
+	valWire int
+	err     error
+}
+
+// NewMapIterator returns an iterator over all entries of the
+// map stored in the given field of bz.
+func NewMapIterator(bz []byte, field int32) MapIterator {
+	return MapIterator{field: field, entries: NewFieldIterator(bz)}
+}
+
+// Next advances to the next entry, returning false when there
+// are no more entries or the data was malformed (check Err).
+func (m *MapIterator) Next() bool {
+	if m.err != nil {
+		return false
+	}
+	for m.entries.Next() {
+		if m.entries.FieldNum() != m.field {
+			continue
+		}
+		if m.entries.WireType() != WireLengthPrefix {
+			m.err = errors.Errorf("Map field %d has wire type %d", m.field, m.entries.WireType())
+			return false
+		}
+		entry, err := ParseBytesField(m.entries.Raw())
+		if err != nil {
+			m.err = err
+			return false
+		}
+		m.err = m.parseEntry(entry)
+		return m.err == nil
+	}
+	m.err = m.entries.Err()
+	return false
+}
+
+// parseEntry sets key and value from the body of one entry.
+// Missing key or value are left nil, as they hold the default.
+func (m *MapIterator) parseEntry(entry []byte) error {
+	m.key, m.keyWire, m.value, m.valWire = nil, 0, nil, 0
+	it := NewFieldIterator(entry)
+	for it.Next() {
+		// last one wins here as well
+		switch it.FieldNum() {
+		case 1:
+			m.key, m.keyWire = it.Raw(), it.WireType()
+		case 2:
+			m.value, m.valWire = it.Raw(), it.WireType()
+		}
+	}
+	return it.Err()
+}
+
+// Key returns the raw key of the current entry and its wire type.
+// If the key was not encoded (it is the default value), the slice is nil.
+func (m *MapIterator) Key() ([]byte, int) {
+	return m.key, m.keyWire
+}
+
+// Value returns the raw value of the current entry and its wire type.
+// If the value was not encoded (it is the default value), the slice is nil.
+func (m *MapIterator) Value() ([]byte, int) {
+	return m.value, m.valWire
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (m *MapIterator) Err() error {
+	return m.err
+}
+
+// LookupMapEntry finds the value for one key in a map<K,V> field,
+// without decoding the whole map. It returns the raw value field
+// and its wire type, which can be parsed as with ExtractField.
+//
+// key may be a string or []byte (for string and bytes keys), or
+// any integer type or bool. Integers are compared to the raw
+// number on the wire, so sint keys must be zigzag encoded by the
+// caller. If the key appears several times, the last entry wins.
+//
+// If the entry exists but has no value (the default value), it
+// returns a nil slice with no error.
+func LookupMapEntry(bz []byte, field int32, key interface{}) ([]byte, int, error) {
+	match, err := mapKeyMatcher(key)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var found bool
+	var value []byte
+	var wireType int
+	it := NewMapIterator(bz, field)
+	for it.Next() {
+		raw, wire := it.Key()
+		ok, err := match(raw, wire)
+		if err != nil {
+			return nil, 0, err
+		}
+		if ok {
+			found = true
+			value, wireType = it.Value()
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, 0, err
+	}
+	if !found {
+		return nil, 0, errors.Wrapf(ErrFieldNotFound, "Key %v in map field %d", key, field)
+	}
+	return value, wireType, nil
+}
+
+// mapKeyMatcher returns a function to compare the raw key
+// of an entry with the one we are looking for
+func mapKeyMatcher(key interface{}) (func([]byte, int) (bool, error), error) {
+	switch k := key.(type) {
+	case string:
+		return matchBytesKey([]byte(k)), nil
+	case []byte:
+		return matchBytesKey(k), nil
+	case bool:
+		if k {
+			return matchIntKey(1), nil
+		}
+		return matchIntKey(0), nil
+	case int:
+		return matchIntKey(uint64(k)), nil
+	case int32:
+		return matchIntKey(uint64(k)), nil
+	case int64:
+		return matchIntKey(uint64(k)), nil
+	case uint:
+		return matchIntKey(uint64(k)), nil
+	case uint32:
+		return matchIntKey(uint64(k)), nil
+	case uint64:
+		return matchIntKey(k), nil
+	default:
+		return nil, errors.Errorf("Unsupported map key type %T", key)
+	}
+}
+
+func matchBytesKey(key []byte) func([]byte, int) (bool, error) {
+	return func(raw []byte, wire int) (bool, error) {
+		// missing key is the empty string
+		if raw == nil {
+			return len(key) == 0, nil
+		}
+		if wire != WireLengthPrefix {
+			return false, errors.Errorf("Map key has wire type %d", wire)
+		}
+		bz, err := ParseBytesField(raw)
+		if err != nil {
+			return false, err
+		}
+		return bytes.Equal(bz, key), nil
+	}
+}
+
+func matchIntKey(key uint64) func([]byte, int) (bool, error) {
+	return func(raw []byte, wire int) (bool, error) {
+		// missing key is zero
+		if raw == nil {
+			return key == 0, nil
+		}
+		val, _, err := ParseAnyInt(wire, raw)
+		if err != nil {
+			return false, err
+		}
+		// fixed32 keys are not sign extended
+		if wire == WireFixed32 {
+			return val == key&0xffffffff, nil
+		}
+		return val == key, nil
+	}
+}
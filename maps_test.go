@@ -0,0 +1,103 @@
+package pbstream
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mapSample has map<string, int32> in field 3 and map<int64, string>
+// in field 4, with a varint in field 1 to skip over
+var mapSample = []byte{
+	0x08, 42,
+	// {"a": 1}
+	0x1a, 5, 0x0a, 1, 'a', 0x10, 1,
+	// {"b": 2}
+	0x1a, 5, 0x0a, 1, 'b', 0x10, 2,
+	// {-1: "x"}
+	0x22, 14, 0x08, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01, 0x12, 1, 'x',
+	// {"a": 7} overrides the first one
+	0x1a, 5, 0x0a, 1, 'a', 0x10, 7,
+	// {"": 9} with default key
+	0x1a, 2, 0x10, 9,
+	// {"z": 0} with default value
+	0x1a, 3, 0x0a, 1, 'z',
+	// {5: "five"}
+	0x22, 8, 0x08, 5, 0x12, 4, 'f', 'i', 'v', 'e',
+}
+
+func TestLookupMapEntry(t *testing.T) {
+	cases := []struct {
+		field     int32
+		key       interface{}
+		isMissing bool
+		eval      assertion
+	}{
+		{3, "a", false, assertInt32(7)},
+		{3, []byte("b"), false, assertInt32(2)},
+		{3, "", false, assertInt32(9)},
+		{3, "c", true, nil},
+		{4, int64(-1), false, assertString("x")},
+		{4, -1, false, assertString("x")},
+		{4, uint32(5), false, assertString("five")},
+		{4, int64(6), true, nil},
+		// key of wrong type
+		{3, 5, true, nil},
+		{4, "a", true, nil},
+		// unsupported key type
+		{3, 1.5, true, nil},
+		// missing map
+		{5, "a", true, nil},
+	}
+
+	for _, tc := range cases {
+		val, wire, err := LookupMapEntry(mapSample, tc.field, tc.key)
+		if tc.isMissing {
+			assert.Error(t, err, "%v", tc.key)
+		} else if assert.NoError(t, err, "%v", tc.key) {
+			tc.eval(t, wire, val)
+		}
+	}
+
+	_, _, err := LookupMapEntry(mapSample, 3, "c")
+	assert.True(t, IsNotFound(err))
+
+	// default value
+	val, _, err := LookupMapEntry(mapSample, 3, "z")
+	assert.NoError(t, err)
+	assert.Nil(t, val)
+}
+
+func TestMapIterator(t *testing.T) {
+	var keys []string
+	var vals []int64
+	it := NewMapIterator(mapSample, 3)
+	for it.Next() {
+		raw, _ := it.Key()
+		key := ""
+		if raw != nil {
+			var err error
+			key, err = ParseString(raw)
+			require.NoError(t, err)
+		}
+		keys = append(keys, key)
+
+		var val uint64
+		raw, wire := it.Value()
+		if raw != nil {
+			var err error
+			val, _, err = ParseAnyInt(wire, raw)
+			require.NoError(t, err)
+		}
+		vals = append(vals, int64(val))
+	}
+	require.NoError(t, it.Err())
+	assert.Equal(t, []string{"a", "b", "a", "", "z"}, keys)
+	assert.Equal(t, []int64{1, 2, 7, 9, 0}, vals)
+
+	// field 1 is a varint, not a message
+	it = NewMapIterator(mapSample, 1)
+	assert.False(t, it.Next())
+	assert.Error(t, it.Err())
+}
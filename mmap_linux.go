@@ -0,0 +1,86 @@
+//go:build linux
+// +build linux
+
+package pbstream
+
+import (
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// MappedFile is a read-only memory mapping of a file. The data
+// is paged in by the kernel as it is touched, so huge files can
+// be searched with ExtractPath (on Bytes) or a ReaderAtExtractor.
+type MappedFile struct {
+	data []byte
+}
+
+// MapFile maps the whole file into memory. Call Close when done,
+// after which no data from it may be used.
+func MapFile(path string) (*MappedFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	size := info.Size()
+	if size == 0 {
+		return &MappedFile{}, nil
+	}
+	if int64(int(size)) != size {
+		return nil, errors.Errorf("File %s too large to map", path)
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &MappedFile{data: data}, nil
+}
+
+// Bytes returns the mapped data
+func (m *MappedFile) Bytes() []byte {
+	return m.data
+}
+
+// Len returns the size of the file
+func (m *MappedFile) Len() int {
+	return len(m.data)
+}
+
+// ReadAt implements io.ReaderAt
+func (m *MappedFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("MappedFile.ReadAt: negative offset")
+	}
+	if off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Extractor returns a ReaderAtExtractor over the whole file
+func (m *MappedFile) Extractor() *ReaderAtExtractor {
+	return NewReaderAtExtractor(m, int64(len(m.data)))
+}
+
+// Close unmaps the file
+func (m *MappedFile) Close() error {
+	if m.data == nil {
+		return nil
+	}
+	err := syscall.Munmap(m.data)
+	m.data = nil
+	return errors.WithStack(err)
+}
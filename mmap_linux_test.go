@@ -0,0 +1,53 @@
+//go:build linux
+// +build linux
+
+package pbstream
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMapFile(t *testing.T) {
+	m, err := MapFile("testdata/send_msg.bin")
+	require.NoError(t, err)
+	defer m.Close()
+
+	bz, err := ioutil.ReadFile("testdata/send_msg.bin")
+	require.NoError(t, err)
+	assert.Equal(t, bz, m.Bytes())
+	assert.Equal(t, len(bz), m.Len())
+
+	sec, err := m.Extractor().ExtractPath(2, 3, 2)
+	require.NoError(t, err)
+	denom, err := sec.Bytes()
+	require.NoError(t, err)
+	assert.Equal(t, "ATOM", string(denom))
+
+	raw, wire, err := ExtractPath(m.Bytes(), 1, 1)
+	require.NoError(t, err)
+	assertInt64(500)(t, wire, raw)
+
+	require.NoError(t, m.Close())
+	assert.Nil(t, m.Bytes())
+
+	// empty files work too
+	dir, err := ioutil.TempDir("", "pbstream")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	empty := filepath.Join(dir, "empty.bin")
+	require.NoError(t, ioutil.WriteFile(empty, nil, 0644))
+	m, err = MapFile(empty)
+	require.NoError(t, err)
+	_, err = m.Extractor().ExtractField(1)
+	assert.True(t, IsNotFound(err))
+	assert.NoError(t, m.Close())
+
+	_, err = MapFile(filepath.Join(dir, "missing.bin"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,56 @@
+package pbstream
+
+import (
+	"github.com/pkg/errors"
+)
+
+// WhichOneof returns which member of a oneof group is set,
+// given the field numbers of all members.
+//
+// If several members appear in the message, protobuf says
+// the last one wins, and that is the one we return.
+// If no member is set, it returns 0 and no error.
+func WhichOneof(bz []byte, candidates ...int32) (int32, error) {
+	var set int32
+	it := NewFieldIterator(bz)
+	for it.Next() {
+		if isCandidate(it.FieldNum(), candidates) {
+			set = it.FieldNum()
+		}
+	}
+	if err := it.Err(); err != nil {
+		return 0, err
+	}
+	return set, nil
+}
+
+// WhichOneofStrict is like WhichOneof, but returns an error if
+// more than one member of the oneof is present. A member that
+// appears several times (to be merged) is allowed.
+func WhichOneofStrict(bz []byte, candidates ...int32) (int32, error) {
+	var set int32
+	it := NewFieldIterator(bz)
+	for it.Next() {
+		field := it.FieldNum()
+		if !isCandidate(field, candidates) {
+			continue
+		}
+		if set != 0 && set != field {
+			return 0, errors.Errorf("Oneof has both fields %d and %d set", set, field)
+		}
+		set = field
+	}
+	if err := it.Err(); err != nil {
+		return 0, err
+	}
+	return set, nil
+}
+
+func isCandidate(field int32, candidates []int32) bool {
+	for _, c := range candidates {
+		if c == field {
+			return true
+		}
+	}
+	return false
+}
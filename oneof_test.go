@@ -0,0 +1,76 @@
+package pbstream
+
+import (
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWhichOneof(t *testing.T) {
+	send, err := ioutil.ReadFile("testdata/send_msg.bin")
+	require.NoError(t, err)
+	issue, err := ioutil.ReadFile("testdata/issue_msg.bin")
+	require.NoError(t, err)
+	// fee only
+	fee := []byte{0x0a, 2, 0x08, 1}
+	// send followed by an empty issue
+	both := append(append([]byte{}, send...), 0x1a, 0)
+	// send, twice
+	twice := append(append([]byte{}, send...), 0x12, 0)
+
+	cases := []struct {
+		bz       []byte
+		expected int32
+		isStrict bool
+	}{
+		{send, 2, true},
+		{issue, 3, true},
+		{fee, 0, true},
+		{both, 3, false},
+		{twice, 2, true},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case-%d", i), func(t *testing.T) {
+			set, err := WhichOneof(tc.bz, 2, 3)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, set)
+
+			set, err = WhichOneofStrict(tc.bz, 2, 3)
+			if tc.isStrict {
+				require.NoError(t, err)
+				assert.Equal(t, tc.expected, set)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+
+	_, err = WhichOneof(send[:len(send)-1], 2, 3)
+	assert.Error(t, err)
+}
+
+// ExampleWhichOneof shows how to tell which message is in a Tx
+//
+// Spec in https://github.com/confio/pbstream/blob/master/_gen/sendtx.proto
+func ExampleWhichOneof() {
+	// In real code, you would check those errors....
+	bz, _ := ioutil.ReadFile("testdata/issue_msg.bin")
+
+	msg, _ := WhichOneof(bz, 2, 3)
+	switch msg {
+	case 2:
+		fmt.Println("Send msg")
+	case 3:
+		raw, _, _ := ExtractPath(bz, 3, 2, 2)
+		denom, _ := ParseString(raw)
+		fmt.Printf("Issue msg: %s\n", denom)
+	default:
+		fmt.Println("No msg")
+	}
+
+	// Output: Issue msg: WIN
+}
@@ -0,0 +1,162 @@
+package pbstream
+
+import (
+	"github.com/pkg/errors"
+)
+
+// PackedIterator lazily walks over the numbers in a packed
+// repeated field, without allocating.
+//
+// Usage:
+//
+//	it, err := NewPackedIterator(WireVarint, raw)
+//	...
+//	for val, ok := it.Next(); ok; val, ok = it.Next() {
+//		...
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type PackedIterator struct {
+	wire int
+	data []byte
+	err  error
+}
+
+// NewPackedIterator takes a WireLengthPrefix field (as returned
+// from ExtractField) and the encoding of each number inside
+// (WireVarint, WireFixed64, WireFixed32), like ParsePackedRepeated.
+func NewPackedIterator(wire int, bz []byte) (PackedIterator, error) {
+	data, err := ParseBytesField(bz)
+	if err != nil {
+		return PackedIterator{}, err
+	}
+	switch wire {
+	case WireVarint:
+	case WireFixed32, WireFixed64:
+		if len(data)%fixedWidth(wire) != 0 {
+			return PackedIterator{}, errors.Errorf("Packed fixed field of %d bytes", len(data))
+		}
+	default:
+		return PackedIterator{}, errors.Errorf("Unknown wireType for packed field: %d", wire)
+	}
+	return PackedIterator{wire: wire, data: data}, nil
+}
+
+// Next returns the next number, or false if there are no more
+// numbers or the data was malformed (check Err).
+func (p *PackedIterator) Next() (uint64, bool) {
+	if p.err != nil || len(p.data) == 0 {
+		return 0, false
+	}
+	val, offset, err := ParseAnyInt(p.wire, p.data)
+	if err != nil {
+		p.err = err
+		return 0, false
+	}
+	p.data = p.data[offset:]
+	return val, true
+}
+
+// Len returns how many numbers are left to read for fixed width
+// encodings. For varints, we cannot know without scanning, and it
+// returns -1.
+func (p *PackedIterator) Len() int {
+	if p.wire == WireVarint {
+		return -1
+	}
+	return len(p.data) / fixedWidth(p.wire)
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (p *PackedIterator) Err() error {
+	return p.err
+}
+
+// CountPacked returns how many numbers are stored in a packed
+// repeated field, taking the same arguments as ParsePackedRepeated.
+//
+// For WireFixed32 and WireFixed64 this only looks at the length.
+// For WireVarint we must scan all numbers once, but nothing is
+// allocated.
+func CountPacked(wire int, bz []byte) (int, error) {
+	it, err := NewPackedIterator(wire, bz)
+	if err != nil {
+		return 0, err
+	}
+	if wire != WireVarint {
+		return it.Len(), nil
+	}
+
+	var count int
+	data := it.data
+	for len(data) > 0 {
+		_, offset, err := parseVarUint(data)
+		if err != nil {
+			return 0, err
+		}
+		data = data[offset:]
+		count++
+	}
+	return count, nil
+}
+
+// ExtractRepeatedScalar collects every value of a repeated
+// numeric field, in wire order.
+//
+// Encoders may write repeated scalars packed (one WireLengthPrefix
+// field) or unpacked (one field per value), and parsers must accept
+// both, even mixed in the same message. elemWire is the encoding
+// of each value (WireVarint, WireFixed64, WireFixed32).
+// If the field is not present, it returns an empty slice.
+func ExtractRepeatedScalar(bz []byte, field int32, elemWire int) ([]uint64, error) {
+	if elemWire != WireVarint && fixedWidth(elemWire) == 0 {
+		return nil, errors.Errorf("Unknown wireType for repeated scalar: %d", elemWire)
+	}
+
+	var res []uint64
+	it := NewFieldIterator(bz)
+	for it.Next() {
+		if it.FieldNum() != field {
+			continue
+		}
+		switch it.WireType() {
+		case WireLengthPrefix:
+			packed, err := NewPackedIterator(elemWire, it.Raw())
+			if err != nil {
+				return nil, err
+			}
+			for val, ok := packed.Next(); ok; val, ok = packed.Next() {
+				res = append(res, val)
+			}
+			if err := packed.Err(); err != nil {
+				return nil, err
+			}
+		case elemWire:
+			val, _, err := ParseAnyInt(elemWire, it.Raw())
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, val)
+		default:
+			return nil, errors.Errorf("Field %d has wire type %d, expected %d", field, it.WireType(), elemWire)
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// fixedWidth returns the number of bytes for WireFixed32
+// and WireFixed64, or 0 for any other encoding.
+func fixedWidth(wire int) int {
+	switch wire {
+	case WireFixed32:
+		return 4
+	case WireFixed64:
+		return 8
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,138 @@
+package pbstream
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPackedIterator(t *testing.T) {
+	bz, err := ioutil.ReadFile("testdata/phonebook.bin")
+	require.NoError(t, err)
+
+	raw, _, err := ExtractField(bz, 3)
+	require.NoError(t, err)
+	it, err := NewPackedIterator(WireVarint, raw)
+	require.NoError(t, err)
+	assert.Equal(t, -1, it.Len())
+	var random []int64
+	for val, ok := it.Next(); ok; val, ok = it.Next() {
+		random = append(random, int64(val))
+	}
+	require.NoError(t, it.Err())
+	assert.Equal(t, []int64{532, -344, 3454230, 543, -234}, random)
+
+	raw, _, err = ExtractField(bz, 4)
+	require.NoError(t, err)
+	it, err = NewPackedIterator(WireFixed32, raw)
+	require.NoError(t, err)
+	assert.Equal(t, 3, it.Len())
+	val, ok := it.Next()
+	assert.True(t, ok)
+	assert.Equal(t, uint64(123), val)
+	assert.Equal(t, 2, it.Len())
+
+	// iterating does not allocate
+	allocs := testing.AllocsPerRun(10, func() {
+		it, _ := NewPackedIterator(WireFixed32, raw)
+		for _, ok := it.Next(); ok; _, ok = it.Next() {
+		}
+	})
+	assert.Equal(t, 0.0, allocs)
+}
+
+func TestPackedIteratorErrors(t *testing.T) {
+	// unknown wire type
+	_, err := NewPackedIterator(WireLengthPrefix, []byte{0})
+	assert.Error(t, err)
+	// fixed32 with 5 bytes
+	_, err = NewPackedIterator(WireFixed32, []byte{5, 1, 2, 3, 4, 5})
+	assert.Error(t, err)
+	// length prefix beyond the buffer
+	_, err = NewPackedIterator(WireVarint, []byte{5, 1, 2})
+	assert.Error(t, err)
+
+	// varint never terminates
+	it, err := NewPackedIterator(WireVarint, []byte{3, 1, 0x80, 0x80})
+	require.NoError(t, err)
+	val, ok := it.Next()
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1), val)
+	_, ok = it.Next()
+	assert.False(t, ok)
+	assert.Error(t, it.Err())
+
+	// and the old api reports the same error
+	_, err = ParsePackedRepeated(WireVarint, []byte{3, 1, 0x80, 0x80})
+	assert.Error(t, err)
+}
+
+func TestExtractRepeatedScalar(t *testing.T) {
+	bz, err := ioutil.ReadFile("testdata/phonebook.bin")
+	require.NoError(t, err)
+
+	// all packed, as written by gogo
+	codes, err := ExtractRepeatedScalar(bz, 4, WireFixed32)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{123, 4567, 846273}, codes)
+
+	// add unpacked codes 7 and 8, then another packed run of 9, 10
+	bz = append(bz, 0x25, 7, 0, 0, 0, 0x25, 8, 0, 0, 0)
+	bz = append(bz, 0x22, 8, 9, 0, 0, 0, 10, 0, 0, 0)
+	codes, err = ExtractRepeatedScalar(bz, 4, WireFixed32)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{123, 4567, 846273, 7, 8, 9, 10}, codes)
+
+	// views is a single varint, which is the unpacked form
+	views, err := ExtractRepeatedScalar(bz, 5, WireVarint)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{34}, views)
+
+	// missing field
+	missing, err := ExtractRepeatedScalar(bz, 9, WireVarint)
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(missing))
+
+	// wrong encoding for the field
+	_, err = ExtractRepeatedScalar(bz, 4, WireFixed64)
+	assert.Error(t, err)
+	_, err = ExtractRepeatedScalar(bz, 5, WireFixed32)
+	assert.Error(t, err)
+	_, err = ExtractRepeatedScalar(bz, 5, WireLengthPrefix)
+	assert.Error(t, err)
+}
+
+func TestCountPacked(t *testing.T) {
+	bz, err := ioutil.ReadFile("testdata/phonebook.bin")
+	require.NoError(t, err)
+
+	raw, _, err := ExtractField(bz, 3)
+	require.NoError(t, err)
+	count, err := CountPacked(WireVarint, raw)
+	require.NoError(t, err)
+	assert.Equal(t, 5, count)
+
+	raw, _, err = ExtractField(bz, 4)
+	require.NoError(t, err)
+	count, err = CountPacked(WireFixed32, raw)
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+	_, err = CountPacked(WireFixed64, raw)
+	assert.Error(t, err)
+
+	// empty is fine
+	count, err = CountPacked(WireVarint, []byte{0})
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	// broken varint at the end
+	_, err = CountPacked(WireVarint, []byte{2, 1, 0x80})
+	assert.Error(t, err)
+
+	allocs := testing.AllocsPerRun(10, func() {
+		CountPacked(WireFixed32, raw)
+	})
+	assert.Equal(t, 0.0, allocs)
+}
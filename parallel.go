@@ -0,0 +1,238 @@
+package pbstream
+
+import (
+	"context"
+	"io"
+	"runtime"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// FilterFunc decides if a message should be kept. index is the
+// position of the message in the stream, starting at 0.
+// It is called concurrently from several goroutines.
+type FilterFunc func(index int, msg []byte) (bool, error)
+
+// EmitFunc receives the messages that were kept. It is only called
+// from one goroutine at a time.
+type EmitFunc func(index int, msg []byte) error
+
+// ParallelOptions configures ParallelScan. Zero values use
+// the defaults.
+type ParallelOptions struct {
+	// Workers is the number of goroutines running the filter
+	// (default runtime.NumCPU())
+	Workers int
+	// BatchSize is how many messages each worker gets at once
+	// (default 1024)
+	BatchSize int
+	// Ordered makes emit see the messages in stream order,
+	// at the cost of holding finished batches until their turn
+	// (at most 2*Workers batches are read ahead)
+	Ordered bool
+	// MaxSize is the largest message allowed
+	// (default DefaultMaxMessageSize)
+	MaxSize int
+}
+
+func (o ParallelOptions) withDefaults() ParallelOptions {
+	if o.Workers <= 0 {
+		o.Workers = runtime.NumCPU()
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = 1024
+	}
+	if o.MaxSize <= 0 {
+		o.MaxSize = DefaultMaxMessageSize
+	}
+	return o
+}
+
+// scanBatch is a run of messages handed to one worker
+type scanBatch struct {
+	seq   int
+	first int
+	msgs  [][]byte
+	keep  []bool
+}
+
+// ParallelScan filters a stream of varint length-delimited messages
+// (as read by MessageScanner) held in memory, typically from MapFile.
+//
+// One goroutine walks the length prefixes and splits the messages
+// into batches, which a pool of workers runs through filter (for
+// example an ExtractPath plus a check). The messages that are kept
+// are passed to emit, in stream order if opts.Ordered is set.
+// The messages point into data, nothing is copied.
+//
+// It stops at the first error from filter or emit, on malformed
+// data, or when ctx is cancelled, and returns that error. Some
+// messages may already have been emitted by then.
+func ParallelScan(ctx context.Context, data []byte, opts ParallelOptions, filter FilterFunc, emit EmitFunc) error {
+	opts = opts.withDefaults()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// remember the first error, and stop everything else
+	var once sync.Once
+	var firstErr error
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	jobs := make(chan *scanBatch, opts.Workers)
+	results := make(chan *scanBatch, opts.Workers)
+	var wg sync.WaitGroup
+
+	// when ordered, a slow batch holds up all the later ones, so
+	// limit how far ahead of it we go, or pending grows without bound
+	var slots chan struct{}
+	if opts.Ordered {
+		slots = make(chan struct{}, 2*opts.Workers)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(jobs)
+		if err := splitBatches(ctx, data, opts, slots, jobs); err != nil {
+			fail(err)
+		}
+	}()
+
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range jobs {
+				if err := batch.run(ctx, filter); err != nil {
+					fail(err)
+					return
+				}
+				select {
+				case results <- batch:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// emit the results here, holding them for their turn if ordered
+	pending := make(map[int]*scanBatch)
+	next := 0
+	for batch := range results {
+		if ctx.Err() != nil {
+			// just drain, so the workers can stop
+			continue
+		}
+		if !opts.Ordered {
+			if err := batch.emit(emit); err != nil {
+				fail(err)
+			}
+			continue
+		}
+		pending[batch.seq] = batch
+		for b, ok := pending[next]; ok && ctx.Err() == nil; b, ok = pending[next] {
+			delete(pending, next)
+			next++
+			if err := b.emit(emit); err != nil {
+				fail(err)
+			}
+			<-slots
+		}
+	}
+
+	// all goroutines are done, so firstErr is safe to read
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// splitBatches walks the length prefixes and sends out batches.
+// If slots is not nil, each batch takes a slot first.
+func splitBatches(ctx context.Context, data []byte, opts ParallelOptions, slots chan struct{}, jobs chan<- *scanBatch) error {
+	batch := &scanBatch{}
+	send := func() bool {
+		if slots != nil {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return false
+			}
+		}
+		select {
+		case jobs <- batch:
+		case <-ctx.Done():
+			return false
+		}
+		batch = &scanBatch{
+			seq:   batch.seq + 1,
+			first: batch.first + len(batch.msgs),
+		}
+		return true
+	}
+
+	for len(data) > 0 {
+		size, offset, err := parseVarUint(data)
+		if err != nil {
+			return err
+		}
+		if size > uint64(opts.MaxSize) {
+			return errors.Errorf("Message of %d bytes larger than max size %d", size, opts.MaxSize)
+		}
+		if size > uint64(len(data)-offset) {
+			return errors.WithStack(io.ErrUnexpectedEOF)
+		}
+		end := offset + int(size)
+		batch.msgs = append(batch.msgs, data[offset:end])
+		data = data[end:]
+
+		if len(batch.msgs) == opts.BatchSize && !send() {
+			return nil
+		}
+	}
+	if len(batch.msgs) > 0 {
+		send()
+	}
+	return nil
+}
+
+// run applies the filter to every message in the batch
+func (b *scanBatch) run(ctx context.Context, filter FilterFunc) error {
+	b.keep = make([]bool, len(b.msgs))
+	for i, msg := range b.msgs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		keep, err := filter(b.first+i, msg)
+		if err != nil {
+			return err
+		}
+		b.keep[i] = keep
+	}
+	return nil
+}
+
+// emit passes on the messages we kept
+func (b *scanBatch) emit(emit EmitFunc) error {
+	for i, msg := range b.msgs {
+		if !b.keep[i] {
+			continue
+		}
+		if err := emit(b.first+i, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package pbstream
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// coinStream writes n delimited Coin{Amount: i, Denom: "A"} messages
+func coinStream(t *testing.T, n int) []byte {
+	var buf bytes.Buffer
+	w := NewDelimitedWriter(&buf)
+	for i := 0; i < n; i++ {
+		var amount [binary.MaxVarintLen64]byte
+		n := binary.PutUvarint(amount[:], uint64(i))
+		msg := append([]byte{0x08}, amount[:n]...)
+		msg = append(msg, 0x12, 1, 'A')
+		require.NoError(t, w.WriteMessage(msg))
+	}
+	return buf.Bytes()
+}
+
+// everyThird keeps the coins with amount divisible by 3
+func everyThird(index int, msg []byte) (bool, error) {
+	raw, wire, err := ExtractPath(msg, 1)
+	if err != nil {
+		return false, err
+	}
+	amount, _, err := ParseAnyInt(wire, raw)
+	if err != nil {
+		return false, err
+	}
+	if int(amount) != index {
+		return false, errors.Errorf("index %d for amount %d", index, amount)
+	}
+	return amount%3 == 0, nil
+}
+
+func TestParallelScan(t *testing.T) {
+	data := coinStream(t, 10000)
+
+	var expected []int
+	for i := 0; i < 10000; i += 3 {
+		expected = append(expected, i)
+	}
+
+	var got []int
+	opts := ParallelOptions{Workers: 4, BatchSize: 100, Ordered: true}
+	err := ParallelScan(context.Background(), data, opts, everyThird, func(index int, msg []byte) error {
+		got = append(got, index)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, expected, got)
+
+	// unordered gets the same set, with the defaults
+	got = nil
+	err = ParallelScan(context.Background(), data, ParallelOptions{}, everyThird, func(index int, msg []byte) error {
+		got = append(got, index)
+		return nil
+	})
+	require.NoError(t, err)
+	sort.Ints(got)
+	assert.Equal(t, expected, got)
+
+	// empty data is fine
+	err = ParallelScan(context.Background(), nil, opts, everyThird, func(int, []byte) error {
+		return errors.New("no messages")
+	})
+	assert.NoError(t, err)
+}
+
+func TestParallelScanReadAhead(t *testing.T) {
+	data := coinStream(t, 1000)
+	opts := ParallelOptions{Workers: 2, BatchSize: 10, Ordered: true}
+
+	// the first batch is slow, the others must wait for it
+	var highest int64
+	filter := func(index int, msg []byte) (bool, error) {
+		if index == 0 {
+			time.Sleep(100 * time.Millisecond)
+			assert.True(t, atomic.LoadInt64(&highest) < int64(2*opts.Workers*opts.BatchSize))
+		}
+		for {
+			cur := atomic.LoadInt64(&highest)
+			if int64(index) <= cur || atomic.CompareAndSwapInt64(&highest, cur, int64(index)) {
+				break
+			}
+		}
+		return everyThird(index, msg)
+	}
+
+	var got int
+	err := ParallelScan(context.Background(), data, opts, filter, func(index int, msg []byte) error {
+		got++
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 334, got)
+}
+
+func TestParallelScanErrors(t *testing.T) {
+	data := coinStream(t, 10000)
+	opts := ParallelOptions{Workers: 4, BatchSize: 10, Ordered: true}
+	keepAll := func(int, []byte) (bool, error) { return true, nil }
+	ignore := func(int, []byte) error { return nil }
+
+	// filter errors
+	bad := errors.New("bad")
+	err := ParallelScan(context.Background(), data, opts, func(index int, _ []byte) (bool, error) {
+		if index == 5000 {
+			return false, bad
+		}
+		return true, nil
+	}, ignore)
+	assert.Equal(t, bad, err)
+
+	// emit errors
+	err = ParallelScan(context.Background(), data, opts, keepAll, func(index int, _ []byte) error {
+		if index == 20 {
+			return bad
+		}
+		return nil
+	})
+	assert.Equal(t, bad, err)
+
+	// cancelled while running
+	ctx, cancel := context.WithCancel(context.Background())
+	var count int
+	err = ParallelScan(ctx, data, opts, keepAll, func(int, []byte) error {
+		count++
+		if count == 100 {
+			cancel()
+		}
+		return nil
+	})
+	assert.Equal(t, context.Canceled, errors.Cause(err))
+	assert.True(t, count < 10000)
+
+	// malformed data
+	err = ParallelScan(context.Background(), data[:len(data)-2], opts, keepAll, ignore)
+	assert.Equal(t, io.ErrUnexpectedEOF, errors.Cause(err))
+	opts.MaxSize = 3
+	err = ParallelScan(context.Background(), data, opts, keepAll, ignore)
+	assert.Error(t, err)
+}
@@ -22,8 +22,17 @@ import (
 var (
 	ErrInvalidLengthSample = fmt.Errorf("proto: negative length found during unmarshaling")
 	ErrIntOverflowSample   = fmt.Errorf("proto: integer overflow")
+
+	// ErrFieldNotFound is returned (wrapped) when the data is valid,
+	// but the requested field is not present. Check with IsNotFound.
+	ErrFieldNotFound = fmt.Errorf("field not found")
 )
 
+// MaxNestingDepth is the deepest nesting of groups (and of embedded
+// messages, where we recurse into them) that we accept, so malicious
+// input cannot overflow the stack. It is the same limit as protoc.
+const MaxNestingDepth = 100
+
 const (
 	WireVarint       int = 0
 	WireFixed64          = 1
@@ -64,14 +73,246 @@ func ExtractField(bz []byte, field int32) ([]byte, int, error) {
 		}
 		bz = bz[skippy:]
 	}
-	return nil, 0, errors.Errorf("Desired field %d not found", field)
+	return nil, 0, errors.Wrapf(ErrFieldNotFound, "Desired field %d", field)
+}
+
+// Field is one occurrence of a field in a message.
+// Raw holds the bytes after the header, in the same
+// form that ExtractField returns them.
+type Field struct {
+	Num      int32
+	WireType int
+	Raw      []byte
+}
+
+// ExtractAll goes through the whole object and returns every
+// occurrence of the given field, in the order they appear.
+//
+// This is needed for repeated fields, especially repeated
+// embedded structs, where ExtractField only returns the first
+// one. If the field is not present, it returns an empty
+// slice and no error.
+func ExtractAll(bz []byte, field int32) ([]Field, error) {
+	var res []Field
+	it := NewFieldIterator(bz)
+	for it.Next() {
+		if it.FieldNum() == field {
+			res = append(res, Field{
+				Num:      field,
+				WireType: it.WireType(),
+				Raw:      it.Raw(),
+			})
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// IsNotFound returns true if the error means the field is absent,
+// rather than the data being malformed.
+func IsNotFound(err error) bool {
+	return errors.Cause(err) == ErrFieldNotFound
+}
+
+// HasField returns true if the field appears at least once.
+// It only returns an error if the data is malformed. The whole
+// buffer is checked, even after the field is found.
+func HasField(bz []byte, field int32) (bool, error) {
+	var found bool
+	it := NewFieldIterator(bz)
+	for it.Next() {
+		if it.FieldNum() == field {
+			found = true
+		}
+	}
+	if err := it.Err(); err != nil {
+		return false, err
+	}
+	return found, nil
+}
+
+// HasPath returns true if the field at the end of the path is
+// present in any occurrence of the embedded messages along the path
+// (see ExtractMergedPath). It only returns an error if the data is
+// malformed.
+func HasPath(bz []byte, next int32, rest ...int32) (bool, error) {
+	_, _, found, err := extractMerged(bz, next, rest)
+	return found, err
 }
 
 // ExtractPath digs into sub-objects, selecting field #1,
 // then field #2 from the bytes that come out, then...
 // Returns the final field or an error if anything failed.
 func ExtractPath(bz []byte, next int32, rest ...int32) ([]byte, int, error) {
-	field, wireType, err := ExtractField(bz, next)
+	first, steps := pathSteps(0, next, rest)
+	return ExtractIndexedPath(bz, first, steps...)
+}
+
+// pathSteps selects the same occurrence of every field in the path
+func pathSteps(index int, next int32, rest []int32) (PathStep, []PathStep) {
+	steps := make([]PathStep, len(rest))
+	for i, field := range rest {
+		steps[i] = At(field, index)
+	}
+	return At(next, index), steps
+}
+
+// CountField returns how many times the field appears in
+// the object, without building a slice like ExtractAll.
+// Useful to check how many elements a repeated field holds.
+func CountField(bz []byte, field int32) (int, error) {
+	var count int
+	it := NewFieldIterator(bz)
+	for it.Next() {
+		if it.FieldNum() == field {
+			count++
+		}
+	}
+	if err := it.Err(); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// ExtractLast goes through the whole object and returns the
+// final occurrence of the field.
+//
+// This matches the protobuf spec for singular scalar fields,
+// where the last value seen wins. ExtractField stops at the
+// first match, and may disagree with proto.Unmarshal if a
+// field was (maliciously?) encoded more than once.
+func ExtractLast(bz []byte, field int32) ([]byte, int, error) {
+	return ExtractIndex(bz, field, Last)
+}
+
+// ExtractLastPath is like ExtractPath, but uses ExtractLast
+// at every level, so duplicated fields along the path resolve
+// the same way as proto.Unmarshal does for scalars.
+//
+// Note that protobuf merges duplicated embedded messages,
+// rather than taking the last one. If a message in the path
+// may be split over several occurrences, use ExtractMergedPath.
+func ExtractLastPath(bz []byte, next int32, rest ...int32) ([]byte, int, error) {
+	first, steps := pathSteps(Last, next, rest)
+	return ExtractIndexedPath(bz, first, steps...)
+}
+
+// ExtractMergedPath digs into sub-objects like ExtractPath, but
+// returns exactly what proto.Unmarshal would see.
+//
+// When an embedded message appears several times, protobuf merges
+// the occurrences, which is the same as parsing the concatenation
+// of their bodies. So the answer is the last occurrence of the
+// final field, taken over all occurrences of every message along
+// the path, in wire order. No message bodies are copied.
+//
+// If the final field is itself an embedded message, this only
+// returns the last occurrence of it. Use ExtractAll to get all
+// the pieces that make up the merged message.
+func ExtractMergedPath(bz []byte, next int32, rest ...int32) ([]byte, int, error) {
+	field, wireType, found, err := extractMerged(bz, next, rest)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !found {
+		return nil, 0, errors.Wrapf(ErrFieldNotFound, "Desired field %d", next)
+	}
+	return field, wireType, nil
+}
+
+// extractMerged does the work for ExtractMergedPath, returning
+// found = false rather than an error when the path is not present
+// in any occurrence.
+func extractMerged(bz []byte, next int32, rest []int32) (res []byte, wireType int, found bool, err error) {
+	it := NewFieldIterator(bz)
+	for it.Next() {
+		if it.FieldNum() != next {
+			continue
+		}
+		// recursion guard - we got to the end, remember the last one
+		if len(rest) == 0 {
+			res, wireType, found = it.Raw(), it.WireType(), true
+			continue
+		}
+
+		sub, err := parseEmbedded(next, it.WireType(), it.Raw())
+		if err != nil {
+			return nil, 0, false, err
+		}
+		field, wire, ok, err := extractMerged(sub, rest[0], rest[1:])
+		if err != nil {
+			return nil, 0, false, err
+		}
+		if ok {
+			res, wireType, found = field, wire, true
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, 0, false, err
+	}
+	return res, wireType, found, nil
+}
+
+// Last can be used as a PathStep index to select the
+// final occurrence of a field, rather than counting from the front
+const Last = -1
+
+// PathStep selects one occurrence of a field in a message.
+// Index counts from 0 in wire order, or use Last.
+type PathStep struct {
+	Field int32
+	Index int
+}
+
+// At is a shortcut to build a PathStep
+func At(field int32, index int) PathStep {
+	return PathStep{Field: field, Index: index}
+}
+
+// ExtractIndex is like ExtractField, but returns the
+// index-th occurrence of the field (starting at 0) rather
+// than the first one. Pass Last to get the final one.
+func ExtractIndex(bz []byte, field int32, index int) ([]byte, int, error) {
+	if index < Last {
+		return nil, 0, errors.Errorf("Invalid index %d", index)
+	}
+
+	var found bool
+	var res []byte
+	var wireType int
+	it := NewFieldIterator(bz)
+	for it.Next() {
+		if it.FieldNum() != field {
+			continue
+		}
+		if index == Last {
+			found, res, wireType = true, it.Raw(), it.WireType()
+			continue
+		}
+		if index == 0 {
+			return it.Raw(), it.WireType(), nil
+		}
+		index--
+	}
+	if err := it.Err(); err != nil {
+		return nil, 0, err
+	}
+	if !found {
+		return nil, 0, errors.Wrapf(ErrFieldNotFound, "Desired field %d", field)
+	}
+	return res, wireType, nil
+}
+
+// ExtractIndexedPath works like ExtractPath, but each step
+// can select which occurrence of a repeated field to dig into.
+//
+// For example, on a PhoneBook, the number of the second entry is:
+//
+//	ExtractIndexedPath(bz, At(2, 1), At(2, 0))
+func ExtractIndexedPath(bz []byte, next PathStep, rest ...PathStep) ([]byte, int, error) {
+	field, wireType, err := ExtractIndex(bz, next.Field, next.Index)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -80,16 +321,16 @@ func ExtractPath(bz []byte, next int32, rest ...int32) ([]byte, int, error) {
 		return field, wireType, nil
 	}
 
-	// pop one off the rest list
-	next, rest = rest[0], rest[1:]
-	// and extract the bytes from the embedded struct in the field
-	bz, err = ParseBytesField(field)
+	// extract the bytes from the embedded struct in the field
+	bz, err = parseEmbedded(next.Field, wireType, field)
 	if err != nil {
 		return nil, 0, err
 	}
+	// and pop one off the rest list
+	next, rest = rest[0], rest[1:]
 
 	// repeat on sub-structure
-	return ExtractPath(bz, next, rest...)
+	return ExtractIndexedPath(bz, next, rest...)
 }
 
 // ParseBytesField takes a WireLengthPrefix field, and
@@ -99,9 +340,37 @@ func ParseBytesField(bz []byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	if size > uint64(len(bz)-offset) {
+		return nil, errors.WithStack(io.ErrUnexpectedEOF)
+	}
 	return bz[offset : offset+int(size)], nil
 }
 
+// ParseGroupField takes a WireBeginGroup field (deprecated proto2
+// groups), and returns the encoded fields inside the group, without
+// the end group marker. Since groups are closed by a marker with
+// the same field number, we need to know which field we are in.
+func ParseGroupField(field int32, bz []byte) ([]byte, error) {
+	body, _, err := skipGroup(field, bz, 1)
+	if err != nil {
+		return nil, err
+	}
+	return bz[:body], nil
+}
+
+// parseEmbedded returns the body of an embedded message, which
+// may be encoded as a WireLengthPrefix field or as a group
+func parseEmbedded(field int32, wireType int, bz []byte) ([]byte, error) {
+	switch wireType {
+	case WireLengthPrefix:
+		return ParseBytesField(bz)
+	case WireBeginGroup:
+		return ParseGroupField(field, bz)
+	default:
+		return nil, errors.Errorf("Field %d is not an embedded message (wire type %d)", field, wireType)
+	}
+}
+
 // ParseString takes a WireLengthPrefix field, and
 // extracts the contents into a string
 func ParseString(bz []byte) (string, error) {
@@ -119,31 +388,24 @@ func ParseString(bz []byte) (string, error) {
 //
 // See: https://developers.google.com/protocol-buffers/docs/encoding#packed
 func ParsePackedRepeated(wire int, bz []byte) ([]uint64, error) {
-	data, err := ParseBytesField(bz)
+	it, err := NewPackedIterator(wire, bz)
 	if err != nil {
 		return nil, err
 	}
 
 	// pre-allocate a reasonable amount of space
-	var bytesPerNum int
-	switch wire {
-	case WireFixed32:
-		bytesPerNum = 4
-	case WireFixed64:
-		bytesPerNum = 8
-	case WireVarint:
-		bytesPerNum = 2
+	size := it.Len()
+	if size < 0 {
+		size = len(it.data) / 2
 	}
-	res := make([]uint64, 0, len(data)/bytesPerNum)
+	res := make([]uint64, 0, size)
 
 	// now, let's keep getting more....
-	for len(data) > 0 {
-		val, offset, err := ParseAnyInt(wire, data)
-		if err != nil {
-			return nil, err
-		}
+	for val, ok := it.Next(); ok; val, ok = it.Next() {
 		res = append(res, val)
-		data = data[offset:]
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
 	}
 
 	return res, nil
@@ -249,8 +511,13 @@ func parseFieldHeader(bz []byte) (offset int, fieldNum int32, wireType int, err
 }
 
 func skipField(bz []byte) (size int, err error) {
+	return skipNested(bz, 0)
+}
+
+// skipNested is skipField inside depth groups
+func skipNested(bz []byte, depth int) (size int, err error) {
 	var i int
-	offset, _, wireType, err := parseFieldHeader(bz)
+	offset, fieldNum, wireType, err := parseFieldHeader(bz)
 	if err != nil {
 		return 0, err
 	}
@@ -272,28 +539,22 @@ func skipField(bz []byte) (size int, err error) {
 		if err != nil {
 			return 0, err
 		}
-		if size < 0 {
-			return 0, ErrInvalidLengthSample
+		i += offset
+		// check before adding, so a huge size cannot wrap around
+		if size > uint64(len(bz)-i) {
+			return 0, errors.WithStack(io.ErrUnexpectedEOF)
 		}
-		i += offset + int(size)
+		i += int(size)
 		return i, nil
 	case WireBeginGroup: // (deprecated)
-		for {
-			// we stop if it hits 4, and return up to that point
-			_, _, innerWireType, err := parseFieldHeader(bz[i:])
-			if innerWireType == 4 {
-				return i, nil
-			}
-			// otherwise, keep skipping the entries in the group
-			next, err := skipField(bz[i:])
-			if err != nil {
-				return 0, err
-			}
-			i += next
+		_, offset, err = skipGroup(fieldNum, bz[i:], depth+1)
+		if err != nil {
+			return 0, err
 		}
+		i += offset
 		return i, nil
 	case WireEndGroup: // (deprecated)
-		return i, nil
+		return 0, errors.Errorf("proto: unexpected end group %d", fieldNum)
 	case WireFixed32:
 		i += 4
 		return i, nil
@@ -301,3 +562,41 @@ func skipField(bz []byte) (size int, err error) {
 		return 0, errors.Errorf("proto: illegal wireType %d", wireType)
 	}
 }
+
+// skipGroup takes the bytes after a begin group header and skips
+// all fields until the matching end group. Nested groups are
+// handled by skipNested. body is the size of the fields in the group,
+// size also includes the end group marker. depth counts this group.
+func skipGroup(field int32, bz []byte, depth int) (body int, size int, err error) {
+	if depth > MaxNestingDepth {
+		return 0, 0, errors.Errorf("Groups nested deeper than %d", MaxNestingDepth)
+	}
+	for {
+		if body >= len(bz) {
+			return 0, 0, errors.WithStack(io.ErrUnexpectedEOF)
+		}
+		// we stop when we hit the end group, and include it
+		offset, innerField, innerWireType, err := parseFieldHeader(bz[body:])
+		if err != nil {
+			return 0, 0, err
+		}
+		if innerWireType == WireEndGroup {
+			if innerField != field {
+				return 0, 0, errors.Errorf("proto: end group %d does not match group %d", innerField, field)
+			}
+			return body, body + offset, nil
+		}
+		// otherwise, keep skipping the entries in the group
+		next, err := skipNested(bz[body:], depth)
+		if err != nil {
+			return 0, 0, err
+		}
+		if next < 0 {
+			return 0, 0, errors.WithStack(ErrInvalidLengthSample)
+		}
+		if next > len(bz)-body {
+			return 0, 0, errors.WithStack(io.ErrUnexpectedEOF)
+		}
+		body += next
+	}
+}
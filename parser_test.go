@@ -1,6 +1,7 @@
 package pbstream
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"testing"
@@ -80,16 +81,15 @@ func TestExtractField(t *testing.T) {
 			},
 		},
 		// this tests use of repeated fields
-		// TODO: handle repeated structs
+		// (see TestExtractAll for repeated structs)
 		3: {
 			"testdata/phonebook.bin",
 			[]check{
 				{[]int32{1}, false, assertString("Friends")},
 
-				// by defaulit only gets first field....
-				// TODO: get them all
-				// {[]int32{2, 1}, false, assertString("John")},
-				// {[]int32{2, 2}, false, assertString("123-4567")},
+				// by default only gets first field....
+				{[]int32{2, 1}, false, assertString("John")},
+				{[]int32{2, 2}, false, assertString("123-4567")},
 				// handle packed repeated fields for varint
 
 				{[]int32{3}, false, assertRepeatedInt(
@@ -151,6 +151,344 @@ func TestExtractField(t *testing.T) {
 	}
 }
 
+func TestExtractAll(t *testing.T) {
+	bz, err := ioutil.ReadFile("testdata/phonebook.bin")
+	require.NoError(t, err)
+
+	numbers, err := ExtractAll(bz, 2)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(numbers))
+
+	expected := []struct {
+		name   string
+		number string
+	}{
+		{"John", "123-4567"},
+		{"Jane", "444-1234"},
+		{"Sammy", "55-666-7777"},
+	}
+	for i, num := range numbers {
+		assert.Equal(t, int32(2), num.Num)
+		assert.Equal(t, WireLengthPrefix, num.WireType)
+		sub, err := ParseBytesField(num.Raw)
+		require.NoError(t, err)
+		raw, wire, err := ExtractField(sub, 1)
+		require.NoError(t, err)
+		assertString(expected[i].name)(t, wire, raw)
+		raw, wire, err = ExtractField(sub, 2)
+		require.NoError(t, err)
+		assertString(expected[i].number)(t, wire, raw)
+	}
+
+	// single field is returned as one element
+	views, err := ExtractAll(bz, 5)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(views))
+	assertInt32(34)(t, views[0].WireType, views[0].Raw)
+
+	// missing field is not an error
+	missing, err := ExtractAll(bz, 7)
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(missing))
+
+	// append two Sig{unknown} to a Tx as field 32
+	tx, err := ioutil.ReadFile("testdata/send_msg.bin")
+	require.NoError(t, err)
+	tx = append(tx, 0x82, 0x02, 4, 0x0a, 2, 0xaa, 0xbb)
+	tx = append(tx, 0x82, 0x02, 3, 0x0a, 1, 0xcc)
+	sigs, err := ExtractAll(tx, 32)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(sigs))
+	sig, err := ParseBytesField(sigs[1].Raw)
+	require.NoError(t, err)
+	raw, wire, err := ExtractField(sig, 1)
+	require.NoError(t, err)
+	assertBytes([]byte{0xcc})(t, wire, raw)
+
+	// corrupt data is an error
+	_, err = ExtractAll(tx[:len(tx)-1], 32)
+	assert.Error(t, err)
+}
+
+func TestCountField(t *testing.T) {
+	bz, err := ioutil.ReadFile("testdata/phonebook.bin")
+	require.NoError(t, err)
+
+	cases := []struct {
+		field int32
+		count int
+	}{
+		{1, 1},
+		{2, 3},
+		{3, 1},
+		{6, 0},
+	}
+	for _, tc := range cases {
+		count, err := CountField(bz, tc.field)
+		require.NoError(t, err)
+		assert.Equal(t, tc.count, count, "%d", tc.field)
+	}
+
+	_, err = CountField(bz[:len(bz)-3], 2)
+	assert.Error(t, err)
+}
+
+func TestPresence(t *testing.T) {
+	bz, err := ioutil.ReadFile("testdata/employee_marmot.bin")
+	require.NoError(t, err)
+
+	has, err := HasField(bz, 2)
+	require.NoError(t, err)
+	assert.True(t, has)
+	has, err = HasField(bz, 3)
+	require.NoError(t, err)
+	assert.False(t, has)
+
+	has, err = HasPath(bz, 2, 1)
+	require.NoError(t, err)
+	assert.True(t, has)
+	has, err = HasPath(bz, 2, 3)
+	require.NoError(t, err)
+	assert.False(t, has)
+	has, err = HasPath(bz, 4, 1)
+	require.NoError(t, err)
+	assert.False(t, has)
+
+	// missing fields can be told apart from bad data
+	_, _, err = ExtractPath(bz, 2, 3)
+	assert.True(t, IsNotFound(err))
+	_, _, err = ExtractIndex(bz, 2, 1)
+	assert.True(t, IsNotFound(err))
+	_, _, err = ExtractMergedPath(bz, 5)
+	assert.True(t, IsNotFound(err))
+
+	broken := bz[:len(bz)-1]
+	_, _, err = ExtractPath(broken, 2, 3)
+	assert.Error(t, err)
+	assert.False(t, IsNotFound(err))
+	_, err = HasField(broken, 3)
+	assert.Error(t, err)
+	// the title comes before the broken part, but we still check it all
+	has, err = HasField(broken, 1)
+	assert.Error(t, err)
+	assert.False(t, has)
+	_, err = HasPath(broken, 2, 3)
+	assert.Error(t, err)
+}
+
+func TestExtractIndexedPath(t *testing.T) {
+	bz, err := ioutil.ReadFile("testdata/phonebook.bin")
+	require.NoError(t, err)
+
+	cases := []struct {
+		path      []PathStep
+		isMissing bool
+		eval      assertion
+	}{
+		{[]PathStep{At(1, 0)}, false, assertString("Friends")},
+		{[]PathStep{At(1, Last)}, false, assertString("Friends")},
+		{[]PathStep{At(1, 1)}, true, nil},
+		{[]PathStep{At(2, 0), At(1, 0)}, false, assertString("John")},
+		{[]PathStep{At(2, 1), At(2, 0)}, false, assertString("444-1234")},
+		{[]PathStep{At(2, 2), At(1, 0)}, false, assertString("Sammy")},
+		{[]PathStep{At(2, Last), At(2, Last)}, false, assertString("55-666-7777")},
+		{[]PathStep{At(2, 3), At(1, 0)}, true, nil},
+		{[]PathStep{At(2, 1), At(3, 0)}, true, nil},
+		{[]PathStep{At(2, -2)}, true, nil},
+		{[]PathStep{At(5, Last)}, false, assertInt32(34)},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case-%d", i), func(t *testing.T) {
+			field, wire, err := ExtractIndexedPath(bz, tc.path[0], tc.path[1:]...)
+			if tc.isMissing {
+				assert.Error(t, err)
+			} else if assert.NoError(t, err) {
+				tc.eval(t, wire, field)
+			}
+		})
+	}
+}
+
+func TestExtractLastPath(t *testing.T) {
+	bz, err := ioutil.ReadFile("testdata/send_msg.bin")
+	require.NoError(t, err)
+	// a second fee: Coin{Amount: 1}
+	bz = append(bz, 0x0a, 2, 0x08, 0x01)
+	// a second sendMsg: SendMsg{Recipient: "hi"}
+	bz = append(bz, 0x12, 4, 0x12, 2, 'h', 'i')
+
+	cases := []struct {
+		path      []int32
+		isMissing bool
+		first     assertion
+		last      assertion
+	}{
+		{[]int32{1, 1}, false, assertInt64(500), assertInt64(1)},
+		{[]int32{2, 2}, false, assertBytes([]byte{0x74, 0x23, 0x12, 0x63, 0x82}), assertBytes([]byte("hi"))},
+		// the last fee doesn't have a denom
+		{[]int32{1, 2}, true, assertString("PHO"), nil},
+		{[]int32{2, 3, 1}, true, assertInt64(18500), nil},
+		{[]int32{3}, true, nil, nil},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case-%d", i), func(t *testing.T) {
+			if tc.first != nil {
+				field, wire, err := ExtractPath(bz, tc.path[0], tc.path[1:]...)
+				if assert.NoError(t, err) {
+					tc.first(t, wire, field)
+				}
+			}
+			field, wire, err := ExtractLastPath(bz, tc.path[0], tc.path[1:]...)
+			if tc.isMissing {
+				assert.Error(t, err)
+			} else if assert.NoError(t, err) {
+				tc.last(t, wire, field)
+			}
+		})
+	}
+}
+
+func TestExtractMergedPath(t *testing.T) {
+	bz, err := ioutil.ReadFile("testdata/send_msg.bin")
+	require.NoError(t, err)
+	// a second fee: Coin{Amount: 1}
+	bz = append(bz, 0x0a, 2, 0x08, 0x01)
+	// a second sendMsg: SendMsg{Recipient: "hi", Amount: Coin{Denom: "X"}}
+	bz = append(bz, 0x12, 9, 0x12, 2, 'h', 'i', 0x1a, 3, 0x12, 1, 'X')
+	// and a third fee: Coin{Denom: "NEW"}
+	bz = append(bz, 0x0a, 5, 0x12, 3, 'N', 'E', 'W')
+
+	cases := []struct {
+		path      []int32
+		isMissing bool
+		eval      assertion
+	}{
+		// amount from second, denom from third fee
+		{[]int32{1, 1}, false, assertInt64(1)},
+		{[]int32{1, 2}, false, assertString("NEW")},
+		{[]int32{1, 3}, true, nil},
+		// sender only in first, recipient overwritten by second
+		{[]int32{2, 1}, false, assertBytes([]byte("12345678901234567890"))},
+		{[]int32{2, 2}, false, assertBytes([]byte("hi"))},
+		// merging two levels deep
+		{[]int32{2, 3, 1}, false, assertInt64(18500)},
+		{[]int32{2, 3, 2}, false, assertString("X")},
+		{[]int32{3, 1}, true, nil},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case-%d", i), func(t *testing.T) {
+			field, wire, err := ExtractMergedPath(bz, tc.path[0], tc.path[1:]...)
+			if tc.isMissing {
+				assert.Error(t, err)
+			} else if assert.NoError(t, err) {
+				tc.eval(t, wire, field)
+			}
+		})
+	}
+
+	// cannot descend into a scalar
+	_, _, err = ExtractMergedPath(bz, 1, 1, 1)
+	assert.Error(t, err)
+}
+
+func TestGroups(t *testing.T) {
+	// {1: 5, group 2 {1: "in", group 3 {1: 7}}, 4: 9}
+	bz := []byte{0x08, 5, 0x13, 0x0a, 2, 'i', 'n', 0x1b, 0x08, 7, 0x1c, 0x14, 0x20, 9}
+
+	cases := []struct {
+		path      []int32
+		isMissing bool
+		eval      assertion
+	}{
+		{[]int32{1}, false, assertInt32(5)},
+		{[]int32{4}, false, assertInt32(9)},
+		{[]int32{2, 1}, false, assertString("in")},
+		{[]int32{2, 3, 1}, false, assertInt32(7)},
+		{[]int32{2, 4}, true, nil},
+		{[]int32{2, 3, 2}, true, nil},
+		{[]int32{1, 1}, true, nil},
+	}
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case-%d", i), func(t *testing.T) {
+			field, wire, err := ExtractPath(bz, tc.path[0], tc.path[1:]...)
+			if tc.isMissing {
+				assert.Error(t, err)
+			} else if assert.NoError(t, err) {
+				tc.eval(t, wire, field)
+			}
+			// all the path variants descend the same way
+			field, wire, err = ExtractMergedPath(bz, tc.path[0], tc.path[1:]...)
+			if tc.isMissing {
+				assert.Error(t, err)
+			} else if assert.NoError(t, err) {
+				tc.eval(t, wire, field)
+			}
+		})
+	}
+
+	// the group body is everything up to the matching end
+	raw, wire, err := ExtractField(bz, 2)
+	require.NoError(t, err)
+	assert.Equal(t, WireBeginGroup, wire)
+	body, err := ParseGroupField(2, raw)
+	require.NoError(t, err)
+	assert.Equal(t, bz[3:11], body)
+
+	// the iterator jumps over the whole group, including end marker
+	var fields []int32
+	it := NewFieldIterator(bz)
+	for it.Next() {
+		fields = append(fields, it.FieldNum())
+	}
+	require.NoError(t, it.Err())
+	assert.Equal(t, []int32{1, 2, 4}, fields)
+
+	bad := map[string][]byte{
+		"unterminated":   {0x13, 0x08, 1},
+		"unterminated 2": {0x13, 0x1b, 0x08, 1, 0x1c},
+		"wrong end":      {0x13, 0x08, 1, 0x1c, 0x20, 9},
+		"stray end":      {0x08, 1, 0x14, 0x20, 9},
+		"truncated":      {0x13, 0x09, 1, 2},
+	}
+	for name, bz := range bad {
+		t.Run(name, func(t *testing.T) {
+			_, _, err := ExtractField(bz, 4)
+			assert.Error(t, err)
+		})
+	}
+}
+
+// nestedGroups is n groups in field 1, one inside the other,
+// then 2: 7 after them
+func nestedGroups(n int) []byte {
+	bz := bytes.Repeat([]byte{0x0b}, n)
+	bz = append(bz, bytes.Repeat([]byte{0x0c}, n)...)
+	return append(bz, 0x10, 7)
+}
+
+func TestNestingDepth(t *testing.T) {
+	raw, wire, err := ExtractField(nestedGroups(MaxNestingDepth), 2)
+	require.NoError(t, err)
+	assertInt32(7)(t, wire, raw)
+
+	_, _, err = ExtractField(nestedGroups(MaxNestingDepth+1), 2)
+	assert.Error(t, err)
+	// this used to blow the stack
+	_, _, err = ExtractField(nestedGroups(8<<20), 2)
+	assert.Error(t, err)
+	it := NewFieldIterator(nestedGroups(MaxNestingDepth + 1))
+	assert.False(t, it.Next())
+	assert.Error(t, it.Err())
+
+	// a length of 2^64-9 must not wrap around
+	huge := []byte{0x0a, 0xf7, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01, 0x10, 7}
+	_, _, err = ExtractField(huge, 2)
+	assert.Error(t, err)
+}
+
 // ExampleExtractPath documents parsing a tx
 //
 // Code to create it in _gen/cmd/gen.go
@@ -0,0 +1,344 @@
+package pbstream
+
+import (
+	"github.com/pkg/errors"
+)
+
+// MaxPushDepth is the deepest nesting of embedded messages and
+// groups the PushParser can track. This bounds its memory.
+const MaxPushDepth = 8
+
+// PushFunc receives the bytes of a requested field. path is the
+// field numbers leading to the field, including the field itself.
+// It is only valid during the call.
+//
+// Varint and fixed fields arrive in one call with the raw bytes,
+// as ExtractField would return them. For WireLengthPrefix fields,
+// data is the payload (without the length prefix), split over one
+// or more calls as the chunks come in. done is true on the last
+// call for each field, which may have empty data.
+type PushFunc func(path []int32, wireType int, data []byte, done bool) error
+
+// the states of the PushParser
+const (
+	pushHeader = iota
+	pushVarint
+	pushFixed
+	pushLength
+	pushPayload
+)
+
+// PushParser is a resumable parser that is fed the message in
+// chunks, for devices that cannot hold the whole message (like an
+// HSM receiving a transaction in 255 byte APDUs).
+//
+// The state is a fixed size, no matter how big the message is:
+// the current path, the bytes remaining in each embedded message,
+// and at most one partial varint. Requested fields are streamed to
+// a callback as they arrive, and nothing is buffered.
+type PushParser struct {
+	onField PushFunc
+	// paths we report, we go into any message that is a prefix
+	paths [][]int32
+
+	// path holds the enclosing messages, then the current field
+	depth int
+	path  [MaxPushDepth + 1]int32
+	// remaining bytes in each message, -1 for groups (and top level)
+	remaining [MaxPushDepth + 1]int64
+
+	state    int
+	wireType int
+	// left is the bytes left in a fixed field or payload
+	left   int64
+	report bool
+
+	// partial varint, for headers, lengths and varint fields
+	varint [10]byte
+	nvar   int
+
+	// groups we don't go into are skipped with a counter, so they
+	// don't use up MaxPushDepth. skipGroup is the outermost one.
+	skipping  int
+	skipGroup int32
+
+	err error
+}
+
+// NewPushParser creates a parser that calls onField with the data of
+// every field whose path (from the top level) is in paths. It only
+// descends into embedded messages and groups that lead to one of
+// those paths, and those are not reported themselves. At most
+// MaxPushDepth of them can be open at once, other groups may be
+// nested as deep as they like. A path may not end on a group, as it
+// is not length prefixed, and finding one there is an error.
+// The paths are not copied, and must not be modified.
+func NewPushParser(onField PushFunc, paths ...[]int32) *PushParser {
+	p := &PushParser{onField: onField, paths: paths}
+	p.remaining[0] = -1
+	return p
+}
+
+// Feed parses the next chunk of the message, calling onField as
+// requested fields arrive. Once it returns an error, the parser
+// is stuck and all later calls return the same error.
+func (p *PushParser) Feed(chunk []byte) error {
+	if p.err != nil {
+		return p.err
+	}
+	for len(chunk) > 0 {
+		n, err := p.step(chunk)
+		if err != nil {
+			p.err = err
+			return err
+		}
+		chunk = chunk[n:]
+	}
+	return nil
+}
+
+// Close checks that the message ended on a field boundary at
+// the top level. Call it after the last chunk.
+func (p *PushParser) Close() error {
+	if p.err != nil {
+		return p.err
+	}
+	if p.state != pushHeader || p.nvar != 0 || p.depth != 0 || p.skipping != 0 {
+		p.err = errors.Errorf("Message ended inside a field (depth %d)", p.depth)
+	}
+	return p.err
+}
+
+// step consumes some bytes from the chunk, returning how many
+func (p *PushParser) step(chunk []byte) (int, error) {
+	switch p.state {
+	case pushHeader, pushVarint, pushLength:
+		// collect one byte at a time until the varint is done
+		if p.nvar == len(p.varint) {
+			return 0, errors.WithStack(ErrIntOverflowSample)
+		}
+		p.varint[p.nvar] = chunk[0]
+		p.nvar++
+		if err := p.consume(1); err != nil {
+			return 0, err
+		}
+		if chunk[0] >= 0x80 {
+			return 1, nil
+		}
+		return 1, p.varintDone()
+	case pushFixed, pushPayload:
+		n := int64(len(chunk))
+		if n > p.left {
+			n = p.left
+		}
+		if err := p.consume(n); err != nil {
+			return 0, err
+		}
+		p.left -= n
+		if p.state == pushFixed {
+			// fixed values are small, keep them in the varint buffer
+			copy(p.varint[p.nvar:], chunk[:n])
+			p.nvar += int(n)
+			if p.left == 0 {
+				return int(n), p.fieldDone(p.varint[:p.nvar])
+			}
+			return int(n), nil
+		}
+		if p.report {
+			if err := p.onField(p.path[:p.depth+1], p.wireType, chunk[:n], p.left == 0); err != nil {
+				return 0, err
+			}
+		}
+		if p.left == 0 {
+			p.state = pushHeader
+			p.closeMessages()
+		}
+		return int(n), nil
+	default:
+		return 0, errors.Errorf("Invalid push parser state %d", p.state)
+	}
+}
+
+// varintDone handles a complete varint in the buffer
+func (p *PushParser) varintDone() error {
+	val, _, err := parseVarUint(p.varint[:p.nvar])
+	if err != nil {
+		return err
+	}
+
+	switch p.state {
+	case pushHeader:
+		p.nvar = 0
+		return p.header(int32(val>>3), int(val&0x7))
+	case pushVarint:
+		return p.fieldDone(p.varint[:p.nvar])
+	default: // pushLength
+		p.nvar = 0
+		if val > uint64(1<<63-1) {
+			return errors.WithStack(ErrInvalidLengthSample)
+		}
+		size := int64(val)
+		if r := p.remaining[p.depth]; r >= 0 && size > r {
+			return errors.Errorf("Field %d longer than its message", p.path[p.depth])
+		}
+		if p.skipping == 0 && p.descend() {
+			if p.depth == MaxPushDepth {
+				return errors.Errorf("Messages nested deeper than %d", MaxPushDepth)
+			}
+			p.depth++
+			p.remaining[p.depth] = size
+			p.state = pushHeader
+			p.closeMessages()
+			return nil
+		}
+		p.state, p.left = pushPayload, size
+		if size == 0 {
+			// step needs data to run, so finish here
+			p.state = pushHeader
+			if p.report {
+				if err := p.onField(p.path[:p.depth+1], p.wireType, nil, true); err != nil {
+					return err
+				}
+			}
+			p.closeMessages()
+		}
+		return nil
+	}
+}
+
+// header starts a new field, after the header was read
+func (p *PushParser) header(fieldNum int32, wireType int) error {
+	if fieldNum <= 0 {
+		return errors.Errorf("proto: illegal tag %d (wire type %d)", fieldNum, wireType)
+	}
+	p.wireType = wireType
+	if p.skipping > 0 {
+		p.report = false
+	} else {
+		p.path[p.depth] = fieldNum
+		p.report = p.requested()
+	}
+
+	switch wireType {
+	case WireVarint:
+		p.state = pushVarint
+	case WireFixed64:
+		p.state, p.left = pushFixed, 8
+	case WireFixed32:
+		p.state, p.left = pushFixed, 4
+	case WireLengthPrefix:
+		p.state = pushLength
+	case WireBeginGroup:
+		if p.report {
+			return errors.Errorf("Field %d is a group, which cannot be pushed", fieldNum)
+		}
+		if p.skipping > 0 || !p.descend() {
+			// we can't jump over a group, but only count how deep we are
+			if p.skipping == 0 {
+				p.skipGroup = fieldNum
+			}
+			p.skipping++
+			p.state = pushHeader
+			return nil
+		}
+		if p.depth == MaxPushDepth {
+			return errors.Errorf("Messages nested deeper than %d", MaxPushDepth)
+		}
+		p.depth++
+		p.remaining[p.depth] = -1
+		p.state = pushHeader
+	case WireEndGroup:
+		if p.skipping > 0 {
+			// without a stack, only the outermost end is checked
+			p.skipping--
+			p.state = pushHeader
+			if p.skipping == 0 {
+				if fieldNum != p.skipGroup {
+					return errors.Errorf("proto: end group %d does not match group %d", fieldNum, p.skipGroup)
+				}
+				p.closeMessages()
+			}
+			return nil
+		}
+		if p.depth == 0 || p.remaining[p.depth] != -1 || p.path[p.depth-1] != fieldNum {
+			return errors.Errorf("proto: unexpected end group %d", fieldNum)
+		}
+		p.depth--
+		p.state = pushHeader
+		p.closeMessages()
+	default:
+		return errors.Errorf("proto: illegal wireType %d", wireType)
+	}
+	return nil
+}
+
+// fieldDone reports a finished scalar field
+func (p *PushParser) fieldDone(raw []byte) error {
+	p.state, p.nvar = pushHeader, 0
+	if p.report {
+		if err := p.onField(p.path[:p.depth+1], p.wireType, raw, true); err != nil {
+			return err
+		}
+	}
+	p.closeMessages()
+	return nil
+}
+
+// consume counts n bytes against all enclosing messages
+func (p *PushParser) consume(n int64) error {
+	for i := 1; i <= p.depth; i++ {
+		if p.remaining[i] < 0 {
+			continue
+		}
+		if n > p.remaining[i] {
+			return errors.Errorf("Field overflows embedded message %d", p.path[i-1])
+		}
+		p.remaining[i] -= n
+	}
+	return nil
+}
+
+// closeMessages leaves all embedded messages we have finished
+func (p *PushParser) closeMessages() {
+	if p.skipping > 0 {
+		// still in a group, any more bytes will overflow the message
+		return
+	}
+	for p.depth > 0 && p.remaining[p.depth] == 0 {
+		p.depth--
+	}
+}
+
+// requested is true if the current path is one of the paths
+func (p *PushParser) requested() bool {
+	cur := p.path[:p.depth+1]
+	for _, path := range p.paths {
+		if equalPath(path, cur) {
+			return true
+		}
+	}
+	return false
+}
+
+// descend is true if the current path is a prefix of one of the paths
+func (p *PushParser) descend() bool {
+	cur := p.path[:p.depth+1]
+	for _, path := range p.paths {
+		if len(path) > len(cur) && equalPath(path[:len(cur)], cur) {
+			return true
+		}
+	}
+	return false
+}
+
+func equalPath(a, b []int32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
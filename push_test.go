@@ -0,0 +1,148 @@
+package pbstream
+
+import (
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pushed collects all data from a PushParser
+type pushed struct {
+	fields []string
+	cur    []byte
+}
+
+func (p *pushed) onField(path []int32, wire int, data []byte, done bool) error {
+	p.cur = append(p.cur, data...)
+	if done {
+		p.fields = append(p.fields, fmt.Sprintf("%v/%d:%x", path, wire, p.cur))
+		p.cur = nil
+	}
+	return nil
+}
+
+// feed sends bz to the parser in chunks of the given size
+func feed(p *PushParser, bz []byte, size int) error {
+	for len(bz) > 0 {
+		n := size
+		if n > len(bz) {
+			n = len(bz)
+		}
+		if err := p.Feed(bz[:n]); err != nil {
+			return err
+		}
+		bz = bz[n:]
+	}
+	return p.Close()
+}
+
+func TestPushParser(t *testing.T) {
+	bz, err := ioutil.ReadFile("testdata/send_msg.bin")
+	require.NoError(t, err)
+
+	expected := []string{
+		"[1 2]/2:50484f",
+		"[2 2]/2:7423126382",
+		"[2 3 1]/0:c49001",
+		"[2 3 2]/2:41544f4d",
+	}
+	for _, size := range []int{1, 2, 3, 7, 255, len(bz)} {
+		t.Run(fmt.Sprintf("chunk-%d", size), func(t *testing.T) {
+			var res pushed
+			p := NewPushParser(res.onField,
+				[]int32{1, 2}, []int32{2, 2}, []int32{2, 3, 1}, []int32{2, 3, 2}, []int32{3, 1})
+			require.NoError(t, feed(p, bz, size))
+			assert.Equal(t, expected, res.fields)
+		})
+	}
+
+	// repeated messages and fixed fields
+	bz, err = ioutil.ReadFile("testdata/phonebook.bin")
+	require.NoError(t, err)
+	var res pushed
+	p := NewPushParser(res.onField, []int32{2, 1}, []int32{4}, []int32{5})
+	require.NoError(t, feed(p, bz, 5))
+	assert.Equal(t, []string{
+		"[2 1]/2:4a6f686e",
+		"[2 1]/2:4a616e65",
+		"[2 1]/2:53616d6d79",
+		"[4]/2:7b000000d7110000c1e90c00",
+		"[5]/0:22",
+	}, res.fields)
+}
+
+func TestPushParserGroups(t *testing.T) {
+	// {1: 5, group 2 {1: "in", group 3 {1: 7}}, 4: 9, 5: ""}
+	bz := []byte{0x08, 5, 0x13, 0x0a, 2, 'i', 'n', 0x1b, 0x08, 7, 0x1c, 0x14, 0x20, 9, 0x2a, 0}
+	var res pushed
+	p := NewPushParser(res.onField, []int32{2, 1}, []int32{2, 3, 1}, []int32{4}, []int32{5})
+	require.NoError(t, feed(p, bz, 1))
+	assert.Equal(t, []string{"[2 1]/2:696e", "[2 3 1]/0:07", "[4]/0:09", "[5]/2:"}, res.fields)
+
+	// groups we don't go into don't count against MaxPushDepth
+	res = pushed{}
+	p = NewPushParser(res.onField, []int32{2})
+	require.NoError(t, feed(p, nestedGroups(MaxPushDepth+10), 3))
+	assert.Equal(t, []string{"[2]/0:07"}, res.fields)
+
+	// a group cannot be pushed
+	p = NewPushParser(res.onField, []int32{2})
+	assert.Error(t, feed(p, bz, 1))
+	// and the end of a skipped group must match
+	p = NewPushParser(res.onField, []int32{4})
+	assert.Error(t, feed(p, []byte{0x13, 0x1b, 0x08, 1, 0x1c, 0x1c, 0x20, 9}, 1))
+	// or be inside the message
+	p = NewPushParser(res.onField, []int32{1, 1})
+	assert.Error(t, feed(p, []byte{0x0a, 3, 0x13, 0x08, 1, 0x14, 0x10, 1}, 1))
+}
+
+func TestPushParserErrors(t *testing.T) {
+	bz, err := ioutil.ReadFile("testdata/send_msg.bin")
+	require.NoError(t, err)
+	var res pushed
+
+	// truncated
+	p := NewPushParser(res.onField, []int32{2, 3, 1})
+	assert.Error(t, feed(p, bz[:len(bz)-3], 4))
+
+	// callback errors stop the parser
+	stop := errors.New("stop")
+	p = NewPushParser(func([]int32, int, []byte, bool) error { return stop }, []int32{1, 1})
+	assert.Equal(t, stop, p.Feed(bz))
+	assert.Equal(t, stop, p.Feed(bz))
+
+	bad := map[string][]byte{
+		// sub message claims 5 bytes, parent only has 3
+		"overflow": {0x0a, 3, 0x12, 5, 1, 2, 3},
+		// the inner field runs past the message
+		"field overflow": {0x0a, 2, 0x08, 0x80, 0x01},
+		"wrong end":      {0x13, 0x08, 1, 0x1c},
+		"unterminated":   {0x13, 0x08, 1},
+		"varint":         {0x08, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01},
+		"zero field":     {0x00, 0x01},
+	}
+	for name, bz := range bad {
+		t.Run(name, func(t *testing.T) {
+			p := NewPushParser(res.onField, []int32{1, 2, 1}, []int32{1, 1})
+			assert.Error(t, feed(p, bz, 1))
+		})
+	}
+
+	// too deep
+	deep := []byte{0x08, 1}
+	for i := 0; i < MaxPushDepth+1; i++ {
+		deep = append([]byte{0x0a, byte(len(deep))}, deep...)
+	}
+	path := make([]int32, MaxPushDepth+2)
+	for i := range path {
+		path[i] = 1
+	}
+	p = NewPushParser(res.onField, path)
+	assert.Error(t, feed(p, deep, 3))
+	p = NewPushParser(res.onField, path[:MaxPushDepth+1])
+	assert.NoError(t, feed(p, deep, 3))
+}
@@ -0,0 +1,187 @@
+package pbstream
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Section is the location of a field value inside an io.ReaderAt,
+// which can be read lazily when needed.
+//
+// For WireLengthPrefix fields, it covers the payload, without the
+// length prefix. For groups, it covers the fields inside the group.
+// For varint and fixed fields, it covers the raw value, which can be
+// parsed with ParseAnyInt (and friends) once read.
+type Section struct {
+	r        io.ReaderAt
+	Offset   int64
+	Length   int64
+	WireType int
+}
+
+// Reader returns a reader over just this section
+func (s Section) Reader() *io.SectionReader {
+	return io.NewSectionReader(s.r, s.Offset, s.Length)
+}
+
+// Bytes reads the whole section into memory
+func (s Section) Bytes() ([]byte, error) {
+	bz := make([]byte, s.Length)
+	n, err := s.r.ReadAt(bz, s.Offset)
+	if n == len(bz) {
+		return bz, nil
+	}
+	return nil, unexpectedEOF(err)
+}
+
+// ReaderAtExtractor finds fields in a message stored in an
+// io.ReaderAt, such as a huge file. It only reads the headers
+// and length prefixes it needs, and jumps over everything else,
+// so the message is never loaded into memory.
+type ReaderAtExtractor struct {
+	r    io.ReaderAt
+	size int64
+}
+
+// NewReaderAtExtractor reads a message of the given size from r
+func NewReaderAtExtractor(r io.ReaderAt, size int64) *ReaderAtExtractor {
+	return &ReaderAtExtractor{r: r, size: size}
+}
+
+// ExtractField finds the first occurrence of field at the top
+// level, like the ExtractField function
+func (e *ReaderAtExtractor) ExtractField(field int32) (Section, error) {
+	return e.ExtractPath(field)
+}
+
+// ExtractPath digs into sub-objects like the ExtractPath function,
+// and returns where the final field is stored
+func (e *ReaderAtExtractor) ExtractPath(next int32, rest ...int32) (Section, error) {
+	sec := Section{r: e.r, Offset: 0, Length: e.size, WireType: WireLengthPrefix}
+	for {
+		var err error
+		sec, err = e.find(next, sec.Offset, sec.Offset+sec.Length)
+		if err != nil {
+			return Section{}, err
+		}
+		// recursion guard - we got to the end
+		if len(rest) == 0 {
+			return sec, nil
+		}
+		if sec.WireType != WireLengthPrefix && sec.WireType != WireBeginGroup {
+			return Section{}, errors.Errorf("Field %d is not an embedded message (wire type %d)", next, sec.WireType)
+		}
+		next, rest = rest[0], rest[1:]
+	}
+}
+
+// find looks for field between start and end
+func (e *ReaderAtExtractor) find(field int32, start, end int64) (Section, error) {
+	pos := start
+	for pos < end {
+		fieldNum, wireType, n, err := e.readHeader(pos, end)
+		if err != nil {
+			return Section{}, err
+		}
+		sec, next, err := e.value(fieldNum, wireType, pos+int64(n), end, 0)
+		if err != nil {
+			return Section{}, err
+		}
+		if fieldNum == field {
+			return sec, nil
+		}
+		pos = next
+	}
+	return Section{}, errors.Wrapf(ErrFieldNotFound, "Desired field %d", field)
+}
+
+// value finds the value of a field starting at pos, and returns
+// it along with the position after the field. depth is the number
+// of groups we are in.
+func (e *ReaderAtExtractor) value(fieldNum int32, wireType int, pos, end int64, depth int) (Section, int64, error) {
+	sec := Section{r: e.r, Offset: pos, WireType: wireType}
+	switch wireType {
+	case WireVarint:
+		_, n, err := e.readVarint(pos, end)
+		if err != nil {
+			return Section{}, 0, err
+		}
+		sec.Length = int64(n)
+	case WireFixed64:
+		sec.Length = 8
+	case WireFixed32:
+		sec.Length = 4
+	case WireLengthPrefix:
+		size, n, err := e.readVarint(pos, end)
+		if err != nil {
+			return Section{}, 0, err
+		}
+		if size > uint64(end-pos-int64(n)) {
+			return Section{}, 0, errors.WithStack(io.ErrUnexpectedEOF)
+		}
+		sec.Offset += int64(n)
+		sec.Length = int64(size)
+	case WireBeginGroup: // (deprecated)
+		if depth >= MaxNestingDepth {
+			return Section{}, 0, errors.Errorf("Groups nested deeper than %d", MaxNestingDepth)
+		}
+		for inner := pos; ; {
+			innerField, innerWireType, n, err := e.readHeader(inner, end)
+			if err != nil {
+				return Section{}, 0, err
+			}
+			if innerWireType == WireEndGroup {
+				if innerField != fieldNum {
+					return Section{}, 0, errors.Errorf("proto: end group %d does not match group %d", innerField, fieldNum)
+				}
+				sec.Length = inner - pos
+				return sec, inner + int64(n), nil
+			}
+			_, inner, err = e.value(innerField, innerWireType, inner+int64(n), end, depth+1)
+			if err != nil {
+				return Section{}, 0, err
+			}
+		}
+	case WireEndGroup: // (deprecated)
+		return Section{}, 0, errors.Errorf("proto: unexpected end group %d", fieldNum)
+	default:
+		return Section{}, 0, errors.Errorf("proto: illegal wireType %d", wireType)
+	}
+
+	next := sec.Offset + sec.Length
+	if next > end {
+		return Section{}, 0, errors.WithStack(io.ErrUnexpectedEOF)
+	}
+	return sec, next, nil
+}
+
+func (e *ReaderAtExtractor) readHeader(pos, end int64) (fieldNum int32, wireType int, n int, err error) {
+	wire, n, err := e.readVarint(pos, end)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	wireType = int(wire & 0x7)
+	fieldNum = int32(wire >> 3)
+	if fieldNum <= 0 {
+		return 0, 0, 0, errors.Errorf("proto: illegal tag %d (wire type %d)", fieldNum, wireType)
+	}
+	return fieldNum, wireType, n, nil
+}
+
+// readVarint reads just enough bytes at pos to parse a varint
+func (e *ReaderAtExtractor) readVarint(pos, end int64) (uint64, int, error) {
+	var buf [10]byte
+	want := int64(len(buf))
+	if end-pos < want {
+		want = end - pos
+	}
+	if want <= 0 {
+		return 0, 0, errors.WithStack(io.ErrUnexpectedEOF)
+	}
+	n, err := e.r.ReadAt(buf[:want], pos)
+	if n == 0 && err != nil {
+		return 0, 0, unexpectedEOF(err)
+	}
+	return parseVarUint(buf[:n])
+}
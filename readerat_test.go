@@ -0,0 +1,117 @@
+package pbstream
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingReaderAt counts how many bytes were read
+type countingReaderAt struct {
+	r    io.ReaderAt
+	read int
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	c.read += n
+	return n, err
+}
+
+func TestReaderAtExtractor(t *testing.T) {
+	files := []string{
+		"testdata/send_msg.bin",
+		"testdata/issue_msg.bin",
+		"testdata/employee_marmot.bin",
+	}
+	paths := [][]int32{{1}, {1, 1}, {1, 2}, {2}, {2, 1}, {2, 2}, {2, 3, 1}, {2, 3, 2}, {3, 2, 2}, {4}}
+
+	// must agree with ExtractPath
+	for _, file := range files {
+		bz, err := ioutil.ReadFile(file)
+		require.NoError(t, err)
+		e := NewReaderAtExtractor(bytes.NewReader(bz), int64(len(bz)))
+		for _, path := range paths {
+			t.Run(fmt.Sprintf("%s-%v", file, path), func(t *testing.T) {
+				raw, wire, err := ExtractPath(bz, path[0], path[1:]...)
+				sec, secErr := e.ExtractPath(path[0], path[1:]...)
+				if err != nil {
+					assert.Error(t, secErr)
+					assert.Equal(t, IsNotFound(err), IsNotFound(secErr))
+					return
+				}
+				require.NoError(t, secErr)
+				assert.Equal(t, wire, sec.WireType)
+				got, err := sec.Bytes()
+				require.NoError(t, err)
+				if wire == WireLengthPrefix {
+					raw, err = ParseBytesField(raw)
+					require.NoError(t, err)
+				}
+				assert.Equal(t, raw[:len(got)], got)
+			})
+		}
+	}
+}
+
+func TestReaderAtExtractorSkips(t *testing.T) {
+	// {1: <1MB of bytes>, group 2 {1: 7}, 3: {1: "deep"}}
+	payload := bytes.Repeat([]byte{0xab}, 1<<20)
+	bz := []byte{0x0a, 0x80, 0x80, 0x40}
+	bz = append(bz, payload...)
+	bz = append(bz, 0x13, 0x08, 7, 0x14, 0x1a, 6, 0x0a, 4, 'd', 'e', 'e', 'p')
+
+	r := &countingReaderAt{r: bytes.NewReader(bz)}
+	e := NewReaderAtExtractor(r, int64(len(bz)))
+	sec, err := e.ExtractPath(3, 1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(bz)-4), sec.Offset)
+	assert.Equal(t, int64(4), sec.Length)
+	// we only read a few headers
+	assert.True(t, r.read < 100, "%d", r.read)
+
+	got, err := ioutil.ReadAll(sec.Reader())
+	require.NoError(t, err)
+	assert.Equal(t, []byte("deep"), got)
+
+	sec, err = e.ExtractPath(2, 1)
+	require.NoError(t, err)
+	assert.Equal(t, WireVarint, sec.WireType)
+	raw, err := sec.Bytes()
+	require.NoError(t, err)
+	assertInt32(7)(t, sec.WireType, raw)
+
+	sec, err = e.ExtractField(1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(payload)), sec.Length)
+
+	// truncated
+	e = NewReaderAtExtractor(bytes.NewReader(bz), int64(len(bz)-2))
+	_, err = e.ExtractPath(3, 1)
+	assert.Error(t, err)
+	assert.False(t, IsNotFound(err))
+	e = NewReaderAtExtractor(bytes.NewReader(bz), 1000)
+	_, err = e.ExtractField(3)
+	assert.Error(t, err)
+	// size larger than the data
+	e = NewReaderAtExtractor(bytes.NewReader(bz[:1000]), int64(len(bz)))
+	_, err = e.ExtractField(3)
+	assert.Error(t, err)
+
+	// groups nested too deep
+	deep := nestedGroups(MaxNestingDepth)
+	e = NewReaderAtExtractor(bytes.NewReader(deep), int64(len(deep)))
+	sec, err = e.ExtractField(2)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(deep)-1), sec.Offset)
+	deep = nestedGroups(MaxNestingDepth + 1)
+	e = NewReaderAtExtractor(bytes.NewReader(deep), int64(len(deep)))
+	_, err = e.ExtractField(2)
+	assert.Error(t, err)
+	assert.False(t, IsNotFound(err))
+}
@@ -0,0 +1,117 @@
+package pbstream
+
+import (
+	"github.com/pkg/errors"
+)
+
+// AnyField can be used as the last step of a RedactPath path to
+// match every field in the message. Field 0 is never valid on the wire.
+const AnyField int32 = 0
+
+// RedactPath returns a copy of bz where the payload of the field at
+// the end of the path is overwritten with fill. Only the payload
+// changes, so the length, and the offset of every other byte, are the
+// same as in the input. This keeps hashes of other ranges valid.
+//
+// Every occurrence of the field is redacted, in every occurrence of
+// the messages along the path. The field must be length prefixed
+// (bytes or string), an embedded message, or a group.
+//
+// As we cannot tell strings from embedded messages without a schema,
+// messages lists the paths (from the top level, like ExtractPath) of
+// the embedded message fields. A message, or a group, is not blanked
+// whole, but every bytes and string field inside it is, all the way
+// down, so the result still parses. An embedded message that is not
+// listed is treated as bytes and blanked whole.
+//
+// If the last step is AnyField, every length prefixed field in the
+// message is redacted, going into messages and groups the same way.
+// Scalars are always left alone.
+func RedactPath(bz []byte, path []int32, fill byte, messages [][]int32) ([]byte, error) {
+	res := make([]byte, len(bz))
+	copy(res, bz)
+	if err := RedactPathInPlace(res, path, fill, messages); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// RedactPathInPlace works like RedactPath, but overwrites bz rather
+// than making a copy. If it returns an error, bz may be partly redacted.
+func RedactPathInPlace(bz []byte, path []int32, fill byte, messages [][]int32) error {
+	if len(path) == 0 {
+		return errors.New("RedactPath needs a path")
+	}
+	for _, field := range path[:len(path)-1] {
+		if field == AnyField {
+			return errors.New("AnyField can only be the last step of a path")
+		}
+	}
+	return redactPath(bz, nil, path, fill, messages, 0)
+}
+
+// redactPath redacts path in bz, which is the message at parent.
+// depth counts the messages we went into.
+func redactPath(bz []byte, parent []int32, path []int32, fill byte, messages [][]int32, depth int) error {
+	if depth > MaxNestingDepth {
+		return errors.Errorf("Messages nested deeper than %d", MaxNestingDepth)
+	}
+	field := path[0]
+	it := NewFieldIterator(bz)
+	for it.Next() {
+		num := it.FieldNum()
+		if field != AnyField && num != field {
+			continue
+		}
+		cur := make([]int32, len(parent)+1)
+		copy(cur, parent)
+		cur[len(parent)] = num
+
+		// the body shares memory with bz, so we write through it
+		if len(path) > 1 {
+			sub, err := parseEmbedded(num, it.WireType(), it.Raw())
+			if err != nil {
+				return err
+			}
+			if err := redactPath(sub, cur, path[1:], fill, messages, depth+1); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// recursion guard - we got to the end, blank it
+		wireType := it.WireType()
+		switch {
+		case wireType == WireBeginGroup || (wireType == WireLengthPrefix && isMessagePath(messages, cur)):
+			// blank all the strings inside, keeping the structure
+			sub, err := parseEmbedded(num, wireType, it.Raw())
+			if err != nil {
+				return err
+			}
+			if err := redactPath(sub, cur, []int32{AnyField}, fill, messages, depth+1); err != nil {
+				return err
+			}
+		case wireType == WireLengthPrefix:
+			payload, err := ParseBytesField(it.Raw())
+			if err != nil {
+				return err
+			}
+			for i := range payload {
+				payload[i] = fill
+			}
+		case field != AnyField:
+			return errors.Errorf("Field %d is not length prefixed (wire type %d)", field, wireType)
+		}
+	}
+	return it.Err()
+}
+
+// isMessagePath is true if path is one of the message paths
+func isMessagePath(messages [][]int32, path []int32) bool {
+	for _, p := range messages {
+		if equalPath(p, path) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,165 @@
+package pbstream
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedactPath(t *testing.T) {
+	bz, err := ioutil.ReadFile("testdata/send_msg.bin")
+	require.NoError(t, err)
+	orig := append([]byte{}, bz...)
+
+	// blank the recipient
+	res, err := RedactPath(bz, []int32{2, 2}, 'x', nil)
+	require.NoError(t, err)
+	assert.Equal(t, orig, bz)
+	assert.Equal(t, buildSendTx("ATOM", nil), orig)
+	require.Equal(t, len(bz), len(res))
+	raw, wire, err := ExtractPath(res, 2, 2)
+	require.NoError(t, err)
+	assertBytes([]byte("xxxxx"))(t, wire, raw)
+
+	// only the payload changed
+	var changed int
+	for i := range bz {
+		if bz[i] != res[i] {
+			changed++
+		}
+	}
+	assert.Equal(t, 5, changed)
+	raw, wire, err = ExtractPath(res, 2, 1)
+	require.NoError(t, err)
+	assertBytes([]byte("12345678901234567890"))(t, wire, raw)
+	raw, wire, err = ExtractPath(res, 2, 3, 2)
+	require.NoError(t, err)
+	assertString("ATOM")(t, wire, raw)
+
+	// in place
+	inPlace := append([]byte{}, bz...)
+	require.NoError(t, RedactPathInPlace(inPlace, []int32{2, 2}, 'x', nil))
+	assert.Equal(t, res, inPlace)
+
+	// missing fields are fine
+	res, err = RedactPath(bz, []int32{3, 1}, 0, nil)
+	require.NoError(t, err)
+	assert.Equal(t, orig, res)
+}
+
+func TestRedactPathRepeated(t *testing.T) {
+	bz, err := ioutil.ReadFile("testdata/phonebook.bin")
+	require.NoError(t, err)
+
+	// every number of every entry
+	res, err := RedactPath(bz, []int32{2, 2}, '*', nil)
+	require.NoError(t, err)
+	require.Equal(t, len(bz), len(res))
+	entries, err := ExtractAll(res, 2)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	for _, entry := range entries {
+		body, err := ParseBytesField(entry.Raw)
+		require.NoError(t, err)
+		number, _, err := ExtractField(body, 2)
+		require.NoError(t, err)
+		str, err := ParseString(number)
+		require.NoError(t, err)
+		assert.Equal(t, strings.Repeat("*", len(str)), str)
+		name, _, err := ExtractField(body, 1)
+		require.NoError(t, err)
+		str, err = ParseString(name)
+		require.NoError(t, err)
+		assert.NotContains(t, str, "*")
+	}
+}
+
+func TestRedactPathWildcard(t *testing.T) {
+	bz, err := ioutil.ReadFile("testdata/send_msg.bin")
+	require.NoError(t, err)
+	messages := [][]int32{{1}, {2}, {2, 3}}
+
+	// every string in the send message
+	res, err := RedactPath(bz, []int32{2, AnyField}, '*', messages)
+	require.NoError(t, err)
+	require.Equal(t, len(bz), len(res))
+	raw, wire, err := ExtractPath(res, 2, 1)
+	require.NoError(t, err)
+	assertBytes(bytes.Repeat([]byte{'*'}, 20))(t, wire, raw)
+	raw, wire, err = ExtractPath(res, 2, 2)
+	require.NoError(t, err)
+	assertBytes(bytes.Repeat([]byte{'*'}, 5))(t, wire, raw)
+	// the amount is a message, so we go inside, and it still parses
+	raw, wire, err = ExtractPath(res, 2, 3, 2)
+	require.NoError(t, err)
+	assertString("****")(t, wire, raw)
+	raw, wire, err = ExtractPath(res, 2, 3, 1)
+	require.NoError(t, err)
+	assertInt64(18500)(t, wire, raw)
+	// but the fee is fine
+	raw, wire, err = ExtractPath(res, 1, 2)
+	require.NoError(t, err)
+	assertString("PHO")(t, wire, raw)
+
+	// the same when the path ends in a message
+	same, err := RedactPath(bz, []int32{2}, '*', messages)
+	require.NoError(t, err)
+	assert.Equal(t, res, same)
+
+	// all the strings in the tx
+	res, err = RedactPath(bz, []int32{AnyField}, '*', messages)
+	require.NoError(t, err)
+	raw, wire, err = ExtractPath(res, 1, 2)
+	require.NoError(t, err)
+	assertString("***")(t, wire, raw)
+	raw, wire, err = ExtractPath(res, 2, 3, 2)
+	require.NoError(t, err)
+	assertString("****")(t, wire, raw)
+
+	// without hints, the amount is blanked as bytes
+	res, err = RedactPath(bz, []int32{2, AnyField}, 0, nil)
+	require.NoError(t, err)
+	raw, wire, err = ExtractPath(res, 2, 3)
+	require.NoError(t, err)
+	assertBytes(make([]byte, 10))(t, wire, raw)
+
+	// scalars are left, groups searched
+	msg := []byte{0x08, 5, 0x13, 0x0a, 2, 'i', 'n', 0x10, 1, 0x14, 0x22, 1, 'z'}
+	res, err = RedactPath(msg, []int32{AnyField}, '-', nil)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x08, 5, 0x13, 0x0a, 2, '-', '-', 0x10, 1, 0x14, 0x22, 1, '-'}, res)
+	res, err = RedactPath(msg, []int32{2}, '-', nil)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x08, 5, 0x13, 0x0a, 2, '-', '-', 0x10, 1, 0x14, 0x22, 1, 'z'}, res)
+}
+
+func TestRedactPathErrors(t *testing.T) {
+	bz, err := ioutil.ReadFile("testdata/send_msg.bin")
+	require.NoError(t, err)
+
+	_, err = RedactPath(bz, nil, 0, nil)
+	assert.Error(t, err)
+	_, err = RedactPath(bz, []int32{AnyField, 2}, 0, nil)
+	assert.Error(t, err)
+	// amount is a varint
+	_, err = RedactPath(bz, []int32{1, 1}, 0, nil)
+	assert.Error(t, err)
+	// cannot go into a string
+	_, err = RedactPath(bz, []int32{1, 1, 1}, 0, nil)
+	assert.Error(t, err)
+	_, err = RedactPath(bz[:len(bz)-1], []int32{2, 3, 2}, 0, nil)
+	assert.Error(t, err)
+
+	// nothing is written on errors found before the walk
+	cp := append([]byte{}, bz...)
+	assert.Error(t, RedactPathInPlace(cp, []int32{AnyField, AnyField}, 0, nil))
+	assert.True(t, bytes.Equal(bz, cp))
+
+	// groups nested too deep
+	_, err = RedactPath(nestedGroups(MaxNestingDepth+1), []int32{AnyField}, 0, nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,418 @@
+package pbstream
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// StreamExtractor pulls fields out of a protobuf message as it is
+// read from an io.Reader, so the whole message never has to be in
+// memory. Fields we are not interested in are discarded as they
+// are read, and only the value of the requested field is returned.
+//
+// The stream can only be read forward. Each call continues from
+// where the last one stopped, so fields must be requested in the
+// order they appear on the wire (which is field number order for
+// most encoders). A field that was passed over is not found again.
+type StreamExtractor struct {
+	r *bufio.Reader
+	// pos is the number of bytes consumed from the stream
+	pos int64
+	// resume is the end of the embedded message where the last path
+	// went in, so the next call can skip back to the top level
+	resume  int64
+	maxSize int64
+	// body is the reader from the last ExtractReader call
+	body *fieldReader
+
+	// when capturing, all bytes consumed are appended to buf
+	capturing bool
+	buf       []byte
+
+	// err is set on malformed data and returned on every later call
+	err error
+}
+
+// NewStreamExtractor reads the message from r. If r is not
+// a *bufio.Reader, it is wrapped in one.
+func NewStreamExtractor(r io.Reader) *StreamExtractor {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &StreamExtractor{r: br}
+}
+
+// SetMaxSize limits the size of the value that ExtractField and
+// ExtractPath will hold in memory. Larger values return an error.
+// The default of 0 means no limit.
+func (s *StreamExtractor) SetMaxSize(max int64) {
+	s.maxSize = max
+}
+
+// ExtractField reads forward until it finds the field at the top
+// level of the message, and returns it in the same form as the
+// ExtractField function. All fields before it are discarded.
+func (s *StreamExtractor) ExtractField(field int32) ([]byte, int, error) {
+	return s.ExtractPath(field)
+}
+
+// ExtractPath reads forward, digging into embedded messages like
+// the ExtractPath function, and returns the value of the final field.
+//
+// Only the returned value is held in memory. After the call, the
+// extractor is back at the top level, so later calls can find
+// fields that come after the first field in the path.
+// Groups can be returned, but not be used as steps in the path.
+//
+// A length prefixed value over the max size is skipped, and the
+// error does not stop later calls, as we know where it ends.
+func (s *StreamExtractor) ExtractPath(next int32, rest ...int32) ([]byte, int, error) {
+	wireType, end, err := s.findPath(next, rest)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	s.capturing, s.buf = true, s.buf[:0]
+	err = s.capture(next, wireType, end)
+	s.capturing = false
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// return a copy, as we reuse buf
+	res := make([]byte, len(s.buf))
+	copy(res, s.buf)
+	return res, wireType, nil
+}
+
+// ExtractReader finds a WireLengthPrefix field like ExtractPath,
+// but rather than loading the value into memory, it returns a reader
+// over the payload (without the length prefix) and its size.
+//
+// This lets us hash or forward a huge bytes field as it streams in.
+// The reader is only valid until the next call on the extractor,
+// which skips whatever was not read, so later fields stay reachable.
+func (s *StreamExtractor) ExtractReader(next int32, rest ...int32) (io.Reader, int64, error) {
+	wireType, end, err := s.findPath(next, rest)
+	if err != nil {
+		return nil, 0, err
+	}
+	if wireType != WireLengthPrefix {
+		// consume it, so we stay in a valid position
+		if err := s.skip(next, wireType, end, 0); err != nil {
+			return nil, 0, s.fail(err)
+		}
+		if end >= 0 && s.pos > end {
+			return nil, 0, s.fail(errors.WithStack(io.ErrUnexpectedEOF))
+		}
+		return nil, 0, errors.Errorf("Field %d is not length prefixed (wire type %d)", next, wireType)
+	}
+
+	size, err := s.readVarint()
+	if err != nil {
+		return nil, 0, s.fail(err)
+	}
+	if size > uint64(1<<63-1) {
+		return nil, 0, s.fail(errors.WithStack(ErrInvalidLengthSample))
+	}
+	// the reader must not run into the fields after the message
+	if end >= 0 && size > uint64(end-s.pos) {
+		return nil, 0, s.fail(errors.WithStack(io.ErrUnexpectedEOF))
+	}
+	// we count the body as consumed, and skip what is left of it later
+	s.body = &fieldReader{r: s.r, n: int64(size)}
+	s.pos += int64(size)
+	return s.body, int64(size), nil
+}
+
+// capture reads the value of the field into buf, checking that it
+// fits in the enclosing message, which ends at end (-1 for the top level)
+func (s *StreamExtractor) capture(fieldNum int32, wireType int, end int64) error {
+	if wireType != WireLengthPrefix {
+		if err := s.skip(fieldNum, wireType, end, 0); err != nil {
+			return s.fail(err)
+		}
+		if end >= 0 && s.pos > end {
+			return s.fail(errors.WithStack(io.ErrUnexpectedEOF))
+		}
+		return nil
+	}
+
+	size, err := s.readVarint()
+	if err != nil {
+		return s.fail(err)
+	}
+	if end >= 0 && size > uint64(end-s.pos) {
+		return s.fail(errors.WithStack(io.ErrUnexpectedEOF))
+	}
+	if size > uint64(1<<63-1) {
+		return s.fail(errors.WithStack(ErrInvalidLengthSample))
+	}
+	if s.maxSize > 0 && int64(len(s.buf))+int64(size) > s.maxSize {
+		// we know the size, so skip it and stay usable
+		s.capturing = false
+		if err := s.discard(int64(size)); err != nil {
+			return s.fail(err)
+		}
+		return errors.Errorf("Field larger than max size %d", s.maxSize)
+	}
+	if err := s.discard(int64(size)); err != nil {
+		return s.fail(err)
+	}
+	return nil
+}
+
+// findPath discards the rest of the last path, then finds the header
+// of the final field in the path. The header is consumed and the
+// reader is positioned at the start of the value. end is where the
+// enclosing message stops, or -1 at the top level.
+func (s *StreamExtractor) findPath(next int32, rest []int32) (int, int64, error) {
+	if s.err != nil {
+		return 0, 0, s.err
+	}
+	if s.body != nil {
+		// pos already includes the body, so don't count it twice
+		left := s.body.n
+		s.body.n, s.body = 0, nil
+		s.pos -= left
+		if err := s.discard(left); err != nil {
+			return 0, 0, s.fail(err)
+		}
+	}
+	if err := s.discard(s.resume - s.pos); err != nil {
+		return 0, 0, s.fail(err)
+	}
+
+	// end is the position where the current embedded message
+	// stops, or -1 at the top level (until EOF)
+	end := int64(-1)
+	for {
+		wireType, err := s.find(next, end)
+		if IsNotFound(err) {
+			return 0, 0, err
+		}
+		if err != nil {
+			return 0, 0, s.fail(err)
+		}
+		// recursion guard - we got to the end
+		if len(rest) == 0 {
+			return wireType, end, nil
+		}
+
+		// go inside the embedded message
+		if wireType != WireLengthPrefix {
+			return 0, 0, s.fail(errors.Errorf("Field %d is not an embedded message (wire type %d)", next, wireType))
+		}
+		size, err := s.readVarint()
+		if err != nil {
+			return 0, 0, s.fail(err)
+		}
+		if end >= 0 && size > uint64(end-s.pos) {
+			return 0, 0, s.fail(errors.WithStack(io.ErrUnexpectedEOF))
+		}
+		if end < 0 {
+			// remember where the first embedded message ends
+			s.resume = s.pos + int64(size)
+		}
+		end = s.pos + int64(size)
+		next, rest = rest[0], rest[1:]
+	}
+}
+
+// find reads fields until the header of the desired field is
+// consumed, or we get to end (or EOF if end is -1)
+func (s *StreamExtractor) find(field int32, end int64) (int, error) {
+	for {
+		if end >= 0 && s.pos >= end {
+			return 0, errors.Wrapf(ErrFieldNotFound, "Desired field %d", field)
+		}
+		if end < 0 {
+			if _, err := s.r.Peek(1); err == io.EOF {
+				return 0, errors.Wrapf(ErrFieldNotFound, "Desired field %d", field)
+			}
+		}
+
+		fieldNum, wireType, err := s.readHeader()
+		if err != nil {
+			return 0, err
+		}
+		if fieldNum == field {
+			return wireType, nil
+		}
+		if err := s.skip(fieldNum, wireType, end, 0); err != nil {
+			return 0, err
+		}
+		if end >= 0 && s.pos > end {
+			return 0, errors.WithStack(io.ErrUnexpectedEOF)
+		}
+	}
+}
+
+// skip consumes the value of a field, whose header was already read.
+// A length prefix may not go past end (unless it is -1), and depth
+// is the number of groups we are in.
+func (s *StreamExtractor) skip(fieldNum int32, wireType int, end int64, depth int) error {
+	switch wireType {
+	case WireVarint:
+		_, err := s.readVarint()
+		return err
+	case WireFixed64:
+		return s.discard(8)
+	case WireLengthPrefix:
+		size, err := s.readVarint()
+		if err != nil {
+			return err
+		}
+		if size > uint64(1<<63-1) {
+			return errors.WithStack(ErrInvalidLengthSample)
+		}
+		if end >= 0 && size > uint64(end-s.pos) {
+			return errors.WithStack(io.ErrUnexpectedEOF)
+		}
+		return s.discard(int64(size))
+	case WireBeginGroup: // (deprecated)
+		if depth >= MaxNestingDepth {
+			return errors.Errorf("Groups nested deeper than %d", MaxNestingDepth)
+		}
+		for {
+			innerField, innerWireType, err := s.readHeader()
+			if err != nil {
+				return err
+			}
+			if innerWireType == WireEndGroup {
+				if innerField != fieldNum {
+					return errors.Errorf("proto: end group %d does not match group %d", innerField, fieldNum)
+				}
+				return nil
+			}
+			if err := s.skip(innerField, innerWireType, end, depth+1); err != nil {
+				return err
+			}
+		}
+	case WireEndGroup: // (deprecated)
+		return errors.Errorf("proto: unexpected end group %d", fieldNum)
+	case WireFixed32:
+		return s.discard(4)
+	default:
+		return errors.Errorf("proto: illegal wireType %d", wireType)
+	}
+}
+
+func (s *StreamExtractor) readHeader() (fieldNum int32, wireType int, err error) {
+	wire, err := s.readVarint()
+	if err != nil {
+		return 0, 0, err
+	}
+	wireType = int(wire & 0x7)
+	fieldNum = int32(wire >> 3)
+	if fieldNum <= 0 {
+		return 0, 0, errors.Errorf("proto: illegal tag %d (wire type %d)", fieldNum, wireType)
+	}
+	return fieldNum, wireType, nil
+}
+
+// readVarint works like parseVarUint, but on the stream
+func (s *StreamExtractor) readVarint() (wire uint64, err error) {
+	const maxShift uint = 64
+	for shift := uint(0); ; shift += 7 {
+		if shift >= maxShift {
+			return 0, errors.WithStack(ErrIntOverflowSample)
+		}
+		b, err := s.r.ReadByte()
+		if err != nil {
+			return 0, unexpectedEOF(err)
+		}
+		s.pos++
+		if s.capturing {
+			// groups are captured a varint at a time, so check here too
+			if s.maxSize > 0 && int64(len(s.buf)) >= s.maxSize {
+				return 0, errors.Errorf("Field larger than max size %d", s.maxSize)
+			}
+			s.buf = append(s.buf, b)
+		}
+		wire |= (uint64(b) & 0x7F) << shift
+		if b < 0x80 {
+			return wire, nil
+		}
+	}
+}
+
+// discard consumes n bytes, appending them to buf if capturing
+func (s *StreamExtractor) discard(n int64) error {
+	if n <= 0 {
+		return nil
+	}
+	if s.capturing {
+		if s.maxSize > 0 && int64(len(s.buf))+n > s.maxSize {
+			return errors.Errorf("Field larger than max size %d", s.maxSize)
+		}
+		// grow as we read, so a bogus length cannot make us allocate
+		for n > 0 {
+			chunk := n
+			if chunk > bufio.MaxScanTokenSize {
+				chunk = bufio.MaxScanTokenSize
+			}
+			start := len(s.buf)
+			s.buf = append(s.buf, make([]byte, chunk)...)
+			if _, err := io.ReadFull(s.r, s.buf[start:]); err != nil {
+				return unexpectedEOF(err)
+			}
+			s.pos += chunk
+			n -= chunk
+		}
+		return nil
+	}
+
+	for n > 0 {
+		chunk := n
+		if chunk > 1<<30 {
+			chunk = 1 << 30
+		}
+		done, err := s.r.Discard(int(chunk))
+		s.pos += int64(done)
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		n -= int64(done)
+	}
+	return nil
+}
+
+// fieldReader works like io.LimitedReader, but reports
+// io.ErrUnexpectedEOF if the stream ends before the field does
+type fieldReader struct {
+	r io.Reader
+	n int64
+}
+
+func (f *fieldReader) Read(p []byte) (int, error) {
+	if f.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > f.n {
+		p = p[:f.n]
+	}
+	n, err := f.r.Read(p)
+	f.n -= int64(n)
+	if err == io.EOF && f.n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// fail makes an error sticky, as we lost our place in the stream
+func (s *StreamExtractor) fail(err error) error {
+	s.err = err
+	return err
+}
+
+// unexpectedEOF converts io.EOF inside a field to io.ErrUnexpectedEOF
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return errors.WithStack(err)
+}
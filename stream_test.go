@@ -0,0 +1,245 @@
+package pbstream
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamExtractor(t *testing.T) {
+	bz, err := ioutil.ReadFile("testdata/send_msg.bin")
+	require.NoError(t, err)
+	s := NewStreamExtractor(iotest.OneByteReader(bytes.NewReader(bz)))
+
+	// not in the fee, but we can still go on
+	_, _, err = s.ExtractPath(1, 3)
+	assert.True(t, IsNotFound(err))
+
+	raw, wire, err := s.ExtractPath(2, 2)
+	require.NoError(t, err)
+	assertBytes([]byte{0x74, 0x23, 0x12, 0x63, 0x82})(t, wire, raw)
+
+	// we already passed fee, so it is gone
+	_, _, err = s.ExtractPath(1, 2)
+	assert.True(t, IsNotFound(err))
+	_, _, err = s.ExtractField(3)
+	assert.True(t, IsNotFound(err))
+}
+
+func TestStreamExtractorMatchesExtractPath(t *testing.T) {
+	bz, err := ioutil.ReadFile("testdata/mixed.bin")
+	require.NoError(t, err)
+
+	// every field in order, in one pass
+	s := NewStreamExtractor(bytes.NewReader(bz))
+	for field := int32(1); field <= 16; field++ {
+		expected, expectedWire, err := ExtractField(bz, field)
+		require.NoError(t, err)
+		raw, wire, err := s.ExtractField(field)
+		require.NoError(t, err)
+		assert.Equal(t, expectedWire, wire)
+		// ExtractField returns the rest of the buffer
+		assert.Equal(t, expected[:len(raw)], raw)
+	}
+
+	bz, err = ioutil.ReadFile("testdata/issue_msg.bin")
+	require.NoError(t, err)
+	s = NewStreamExtractor(bytes.NewReader(bz))
+	raw, wire, err := s.ExtractPath(1, 1)
+	require.NoError(t, err)
+	assertInt64(600)(t, wire, raw)
+	raw, wire, err = s.ExtractPath(3, 2, 2)
+	require.NoError(t, err)
+	assertString("WIN")(t, wire, raw)
+}
+
+func TestStreamExtractorLargeField(t *testing.T) {
+	// {1: <1MB of bytes>, 2: 17}
+	payload := bytes.Repeat([]byte{0xab}, 1<<20)
+	bz := []byte{0x0a, 0x80, 0x80, 0x40}
+	bz = append(bz, payload...)
+	bz = append(bz, 0x10, 17)
+
+	s := NewStreamExtractor(bytes.NewReader(bz))
+	s.SetMaxSize(1000)
+	raw, wire, err := s.ExtractField(2)
+	require.NoError(t, err)
+	assertInt32(17)(t, wire, raw)
+
+	// but we cannot load the big one
+	s = NewStreamExtractor(bytes.NewReader(bz))
+	s.SetMaxSize(1000)
+	_, _, err = s.ExtractField(1)
+	assert.Error(t, err)
+	// but we know where it ends, so we can go on
+	raw, wire, err = s.ExtractField(2)
+	require.NoError(t, err)
+	assertInt32(17)(t, wire, raw)
+
+	// groups are held to the limit as well
+	group := []byte{0x0b}
+	for i := 0; i < 1000; i++ {
+		group = append(group, 0x08, 1)
+	}
+	group = append(group, 0x0c)
+	s = NewStreamExtractor(bytes.NewReader(group))
+	s.SetMaxSize(10)
+	_, _, err = s.ExtractField(1)
+	assert.Error(t, err)
+	s = NewStreamExtractor(bytes.NewReader(group))
+	raw, wire, err = s.ExtractField(1)
+	require.NoError(t, err)
+	assert.Equal(t, WireBeginGroup, wire)
+	assert.Equal(t, group[1:], raw)
+
+	// unless allowed
+	s = NewStreamExtractor(bytes.NewReader(bz))
+	raw, wire, err = s.ExtractField(1)
+	require.NoError(t, err)
+	assertBytes(payload)(t, wire, raw)
+}
+
+func TestStreamExtractorReader(t *testing.T) {
+	// {1: "hi", 2: <1MB of bytes>, 3: {1: <1MB>, 2: 7}, 4: 17}
+	payload := bytes.Repeat([]byte{0xab}, 1<<20)
+	bz := []byte{0x0a, 2, 'h', 'i', 0x12, 0x80, 0x80, 0x40}
+	bz = append(bz, payload...)
+	bz = append(bz, 0x1a, 0x86, 0x80, 0x40, 0x0a, 0x80, 0x80, 0x40)
+	bz = append(bz, payload...)
+	bz = append(bz, 0x10, 7, 0x20, 17)
+
+	s := NewStreamExtractor(iotest.HalfReader(bytes.NewReader(bz)))
+	s.SetMaxSize(1000)
+
+	// read a bit of the first one
+	r, size, err := s.ExtractReader(1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), size)
+	got, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hi"), got)
+
+	// hash it all
+	r, size, err = s.ExtractReader(2)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(payload)), size)
+	n, err := io.Copy(ioutil.Discard, r)
+	require.NoError(t, err)
+	assert.Equal(t, size, n)
+
+	// only read some of an embedded one
+	r, size, err = s.ExtractReader(3, 1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(payload)), size)
+	_, err = io.ReadFull(r, make([]byte, 100))
+	require.NoError(t, err)
+
+	// and we can still get the end
+	raw, wire, err := s.ExtractField(4)
+	require.NoError(t, err)
+	assertInt32(17)(t, wire, raw)
+	// the old reader is closed
+	n, err = io.Copy(ioutil.Discard, r)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), n)
+
+	// scalars have no reader, but we can move on
+	s = NewStreamExtractor(bytes.NewReader(bz))
+	_, _, err = s.ExtractReader(3, 2)
+	assert.Error(t, err)
+	raw, wire, err = s.ExtractField(4)
+	require.NoError(t, err)
+	assertInt32(17)(t, wire, raw)
+
+	// truncated body is reported
+	s = NewStreamExtractor(bytes.NewReader(bz[:1000]))
+	r, _, err = s.ExtractReader(2)
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(r)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	_, _, err = s.ExtractField(4)
+	assert.Error(t, err)
+
+	// the reader cannot go past the end of its message
+	bad := []byte{0x0a, 0x03, 0x12, 0x05, 'x', 0x18, 7, 0x20, 8}
+	s = NewStreamExtractor(bytes.NewReader(bad))
+	_, _, err = s.ExtractReader(1, 2)
+	assert.Equal(t, io.ErrUnexpectedEOF, errors.Cause(err))
+	bad = []byte{0x0a, 2, 0x09, 1, 2, 3, 4, 5, 6, 7, 8, 0x10, 1}
+	s = NewStreamExtractor(bytes.NewReader(bad))
+	_, _, err = s.ExtractReader(1, 1)
+	assert.Equal(t, io.ErrUnexpectedEOF, errors.Cause(err))
+}
+
+func TestStreamExtractorGroups(t *testing.T) {
+	// {1: 5, group 2 {1: "in", group 3 {1: 7}}, 4: 9}
+	bz := []byte{0x08, 5, 0x13, 0x0a, 2, 'i', 'n', 0x1b, 0x08, 7, 0x1c, 0x14, 0x20, 9}
+
+	s := NewStreamExtractor(bytes.NewReader(bz))
+	raw, wire, err := s.ExtractField(4)
+	require.NoError(t, err)
+	assertInt32(9)(t, wire, raw)
+
+	s = NewStreamExtractor(bytes.NewReader(bz))
+	raw, wire, err = s.ExtractField(2)
+	require.NoError(t, err)
+	assert.Equal(t, WireBeginGroup, wire)
+	assert.Equal(t, bz[3:12], raw)
+
+	// cannot descend in a stream
+	s = NewStreamExtractor(bytes.NewReader(bz))
+	_, _, err = s.ExtractPath(2, 1)
+	assert.Error(t, err)
+	assert.False(t, IsNotFound(err))
+}
+
+func TestStreamExtractorErrors(t *testing.T) {
+	bz, err := ioutil.ReadFile("testdata/send_msg.bin")
+	require.NoError(t, err)
+
+	// truncated in the middle of the send msg
+	s := NewStreamExtractor(bytes.NewReader(bz[:20]))
+	_, _, err = s.ExtractPath(2, 3, 1)
+	require.Error(t, err)
+	assert.False(t, IsNotFound(err))
+	// sticky error
+	_, _, err2 := s.ExtractField(32)
+	assert.Equal(t, err, err2)
+
+	// reader errors are passed on
+	s = NewStreamExtractor(iotest.TimeoutReader(iotest.OneByteReader(bytes.NewReader(bz))))
+	_, _, err = s.ExtractField(3)
+	assert.Equal(t, iotest.ErrTimeout, errors.Cause(err))
+
+	// embedded message longer than its parent
+	bad := []byte{0x0a, 2, 0x12, 5, 'a', 'b', 'c', 'd', 'e'}
+	s = NewStreamExtractor(bytes.NewReader(bad))
+	_, _, err = s.ExtractPath(1, 2, 1)
+	assert.Equal(t, io.ErrUnexpectedEOF, errors.Cause(err))
+
+	// the value goes past the end of its message
+	bad = []byte{0x0a, 0x03, 0x12, 0x05, 'x', 0x18, 7, 0x20, 8}
+	s = NewStreamExtractor(bytes.NewReader(bad))
+	_, _, err = s.ExtractPath(1, 2)
+	assert.Equal(t, io.ErrUnexpectedEOF, errors.Cause(err))
+	bad = []byte{0x0a, 2, 0x09, 1, 2, 3, 4, 5, 6, 7, 8, 0x10, 1}
+	s = NewStreamExtractor(bytes.NewReader(bad))
+	_, _, err = s.ExtractPath(1, 1)
+	assert.Equal(t, io.ErrUnexpectedEOF, errors.Cause(err))
+
+	// groups nested too deep
+	s = NewStreamExtractor(bytes.NewReader(nestedGroups(MaxNestingDepth)))
+	raw, wire, err := s.ExtractField(2)
+	require.NoError(t, err)
+	assertInt32(7)(t, wire, raw)
+	s = NewStreamExtractor(bytes.NewReader(nestedGroups(MaxNestingDepth + 1)))
+	_, _, err = s.ExtractField(2)
+	assert.Error(t, err)
+	assert.False(t, IsNotFound(err))
+}